@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	agent "distr-comp/internal/agent/client"
 	"distr-comp/internal/logger"
+	"distr-comp/internal/tracing"
 	"os"
 	"strconv"
 )
@@ -24,8 +26,35 @@ func main() {
 	orchestratorURL := getEnvOrDefault("ORCHESTRATOR_URL", "http://localhost:8080")
 	logger.Infof("Orchestrator URL set to: %s", orchestratorURL)
 
+	transport := getEnvOrDefault("AGENT_TRANSPORT", agent.TransportHTTP)
+	if transport != agent.TransportHTTP && transport != agent.TransportGRPC {
+		logger.Fatalf("Unknown AGENT_TRANSPORT %q, expected %q or %q", transport, agent.TransportHTTP, agent.TransportGRPC)
+	}
+	grpcAddr := getEnvOrDefault("ORCHESTRATOR_GRPC_ADDR", "localhost:9090")
+
+	metricsAddr := ""
+	if metricsPort := getEnvOrDefault("METRICS_PORT", "9100"); metricsPort != "" {
+		metricsAddr = ":" + metricsPort
+	}
+
+	shutdownTracing, err := tracing.Setup(tracing.Config{
+		ServiceName: "distr-comp-agent",
+		Exporter:    getEnvOrDefault("TRACING_EXPORTER", tracing.ExporterNone),
+		File:        os.Getenv("TRACING_FILE"),
+	})
+	if err != nil {
+		logger.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	logger.Infof("Starting agent with %d computing goroutines", computingPower)
-	agent.Start(computingPower, orchestratorURL)
+	agent.Start(agent.Config{
+		ComputingPower:  computingPower,
+		OrchestratorURL: orchestratorURL,
+		Transport:       transport,
+		GRPCAddr:        grpcAddr,
+		MetricsAddr:     metricsAddr,
+	})
 }
 
 func getEnvOrDefault(key, defaultValue string) string {
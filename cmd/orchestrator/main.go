@@ -1,25 +1,112 @@
 package main
 
 import (
+	"context"
 	"distr-comp/internal/logger"
+	core "distr-comp/internal/orchestrator/core"
 	server "distr-comp/internal/orchestrator/server"
+	store "distr-comp/internal/orchestrator/store"
+	"distr-comp/internal/tracing"
 	"fmt"
+	"net/netip"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 func main() {
-	timeAddition := parseDurationEnv("TIME_ADDITION", 2000)
-	timeSubtraction := parseDurationEnv("TIME_SUBTRACTION", 2000)
-	timeMultiplication := parseDurationEnv("TIME_MULTIPLICATION", 2000)
-	timeDivision := parseDurationEnv("TIME_DIVISION", 2000)
+	operationTimes := map[string]time.Duration{
+		"+":  parseDurationEnv("TIME_ADDITION", 2000),
+		"-":  parseDurationEnv("TIME_SUBTRACTION", 2000),
+		"*":  parseDurationEnv("TIME_MULTIPLICATION", 2000),
+		"/":  parseDurationEnv("TIME_DIVISION", 2000),
+		"^":  parseDurationEnv("TIME_EXPONENTIATION", 2000),
+		"%":  parseDurationEnv("TIME_MODULO", 2000),
+		"//": parseDurationEnv("TIME_INTEGER_DIVISION", 2000),
+
+		"sqrt": parseDurationEnv("TIME_SQRT", 2000),
+		"sin":  parseDurationEnv("TIME_SIN", 2000),
+		"cos":  parseDurationEnv("TIME_COS", 2000),
+		"log":  parseDurationEnv("TIME_LOG", 2000),
+		"abs":  parseDurationEnv("TIME_ABS", 2000),
+		"min":  parseDurationEnv("TIME_MIN", 2000),
+		"max":  parseDurationEnv("TIME_MAX", 2000),
+		"pow":  parseDurationEnv("TIME_POW", 2000),
+	}
 	port := getEnvOrDefaultInt("PORT", 8080)
+	storePath := getEnvOrDefault("STORE_PATH", "orchestrator.db")
+	grpcPort := getEnvOrDefault("GRPC_PORT", "9090")
+
+	shutdownTracing, err := tracing.Setup(tracing.Config{
+		ServiceName: "distr-comp-orchestrator",
+		Exporter:    getEnvOrDefault("TRACING_EXPORTER", tracing.ExporterNone),
+		File:        os.Getenv("TRACING_FILE"),
+	})
+	if err != nil {
+		logger.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	st, err := openStore(storePath)
+	if err != nil {
+		logger.Fatalf("Failed to open store: %v", err)
+	}
+	defer st.Close()
+
+	cfg := core.Config{
+		OperationTimes:     operationTimes,
+		LocalEvalThreshold: parseDurationEnv("LOCAL_EVAL_THRESHOLD", 0),
+		SchedulingPolicy:   getEnvOrDefault("SCHEDULER_POLICY", core.PolicyWeighted),
+		AgentCapacity:      getEnvOrDefaultInt("AGENT_CAPACITY", 0),
+		AgentTimeout:       parseDurationEnv("AGENT_TIMEOUT", 15000) * time.Millisecond,
+		WebhookSecret:      os.Getenv("WEBHOOK_SECRET"),
+	}
+	if cfg.WebhookSecret == "" {
+		logger.Warn("WEBHOOK_SECRET is empty, webhooks will be sent unsigned")
+	}
+	cfg.WebhookAllowedNetworks, err = parsePrefixesEnv("WEBHOOK_ALLOWED_NETWORKS")
+	if err != nil {
+		logger.Fatalf("Invalid WEBHOOK_ALLOWED_NETWORKS: %v", err)
+	}
+
+	server, err := server.NewServer(cfg, st)
+	if err != nil {
+		logger.Fatalf("Failed to create server: %v", err)
+	}
+
+	if grpcPort != "" {
+		go func() {
+			logger.Infof("Serving the agent protocol over gRPC on port %s", grpcPort)
+			if err := server.RunGRPC(":" + grpcPort); err != nil {
+				logger.Fatalf("Failed to serve gRPC: %v", err)
+			}
+		}()
+	} else {
+		logger.Info("GRPC_PORT is empty, agents can only connect over HTTP")
+	}
 
-	server := server.NewServer(timeAddition, timeSubtraction, timeMultiplication, timeDivision)
 	server.Run(fmt.Sprintf(":%d", port))
 }
 
+func openStore(path string) (store.Store, error) {
+	if path == "" {
+		logger.Warn("STORE_PATH is empty, expressions will not survive a restart")
+		return store.NewNopStore(), nil
+	}
+	logger.Infof("Using store at %s", path)
+	return store.NewBoltStore(path)
+}
+
+func getEnvOrDefault(key, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		logger.Debugf("Environment variable %s found with value: %s", key, value)
+		return value
+	}
+	logger.Debugf("Environment variable %s not found, using default: %s", key, defaultValue)
+	return defaultValue
+}
+
 func parseDurationEnv(key string, defaultValue int) time.Duration {
 	if value, exists := os.LookupEnv(key); exists {
 		if intValue, err := strconv.Atoi(value); err == nil {
@@ -32,6 +119,23 @@ func parseDurationEnv(key string, defaultValue int) time.Duration {
 	return time.Duration(defaultValue)
 }
 
+// parsePrefixesEnv reads a comma-separated list of CIDR prefixes, e.g.
+// "127.0.0.0/8,10.1.0.0/16".
+func parsePrefixesEnv(key string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
 func getEnvOrDefaultInt(key string, defaultValue int) int {
 	if value, exists := os.LookupEnv(key); exists {
 		if intValue, err := strconv.Atoi(value); err == nil {
@@ -2,68 +2,337 @@ package agent
 
 import (
 	"bytes"
+	"context"
+	errs "distr-comp/internal/agent/errors"
+	"distr-comp/internal/calc"
 	"distr-comp/internal/logger"
+	"distr-comp/internal/tracing"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func Start(computingPower int, orchestratorURL string) {
-	logger.Infof("Starting agent with orchestrator URL: %s", orchestratorURL)
-	agent := NewAgent(orchestratorURL)
-
-	var wg sync.WaitGroup
-	wg.Add(computingPower)
-
-	for i := 0; i < computingPower; i++ {
-		go func(workerID int) {
-			logger.Infof("Starting worker #%d", workerID)
-			defer wg.Done()
-
-			for {
-				task, err := agent.GetTask()
-				if err != nil {
-					logger.Errorf("Worker #%d: Failed to get task: %v", workerID, err)
-					time.Sleep(time.Millisecond * 200)
-					continue
-				} else if task == nil {
-					time.Sleep(time.Millisecond * 350)
-					continue
-				}
-
-				logger.Infof("Worker #%d: Processing task %s: %s %v %v", workerID, task.ID, task.Operation, task.Arg1, task.Arg2)
-				result, err := SolveTask(task)
-				if err != nil {
-					logger.Errorf("Worker #%d: Failed to solve task %s: %v", workerID, task.ID, err)
-					time.Sleep(time.Millisecond * 200)
-					continue
-				}
-
-				logger.Infof("Worker #%d: Completed task %s with result %v", workerID, task.ID, result.Result)
-				if err := agent.SubmitResult(result); err != nil {
-					logger.Errorf("Worker #%d: Failed to submit result for task %s: %v", workerID, task.ID, err)
-				}
+var tracer = otel.Tracer("distr-comp/internal/agent")
+
+// Start runs the agent until the process exits. Tasks are fetched over the
+// transport selected in cfg; an agent configured for gRPC falls back to HTTP
+// when it cannot reach the orchestrator's gRPC endpoint at startup.
+func Start(cfg Config) {
+	logger.Infof("Starting agent with orchestrator URL: %s, transport: %s", cfg.OrchestratorURL, cfg.Transport)
+	agent := NewAgent(cfg.OrchestratorURL, cfg.ComputingPower)
+	if cfg.MetricsAddr != "" {
+		go func() {
+			if err := agent.ServeMetrics(cfg.MetricsAddr); err != nil {
+				logger.Errorf("Failed to serve metrics on %s: %v", cfg.MetricsAddr, err)
+			}
+		}()
+	}
+
+	// idle holds a token for every worker that is neither busy nor has a
+	// task waiting for it, so the agent never fetches more than it can run.
+	idle := make(chan struct{}, cfg.ComputingPower)
+	jobs := make(chan job, cfg.ComputingPower)
+	outcomes := make(chan *TaskOutcome, cfg.ComputingPower)
+
+	for i := 0; i < cfg.ComputingPower; i++ {
+		idle <- struct{}{}
+		go agent.runWorker(i, jobs, idle, outcomes)
+	}
+
+	if cfg.Transport == TransportGRPC {
+		if err := agent.runGRPC(cfg.GRPCAddr, jobs, idle, outcomes); err != nil {
+			logger.Warnf("gRPC transport unavailable, falling back to HTTP: %v", err)
+		}
+	}
+	agent.runHTTP(jobs, idle, outcomes)
+}
+
+// runHTTP drives the worker pool over the HTTP endpoints. It never returns.
+func (a *Agent) runHTTP(jobs chan<- job, idle chan struct{}, outcomes <-chan *TaskOutcome) {
+	for {
+		if err := a.Register(); err != nil {
+			logger.Errorf("Failed to register with the orchestrator, retrying: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		break
+	}
+	go a.runHeartbeats()
+	go a.submitOutcomes(outcomes)
+
+	a.fetchTasks(jobs, idle)
+}
+
+// job is a fetched task with the context that aborts it on cancellation.
+type job struct {
+	task *Task
+	ctx  context.Context
+}
+
+// maxOutcomeBatch caps the number of outcomes submitted in one request.
+const maxOutcomeBatch = 100
+
+// fetchTasks requests as many tasks as there are idle workers and hands them
+// to the worker pool through jobs.
+func (a *Agent) fetchTasks(jobs chan<- job, idle chan struct{}) {
+	for {
+		<-idle
+		free := 1
+	drain:
+		for {
+			select {
+			case <-idle:
+				free++
+			default:
+				break drain
 			}
-		}(i)
+		}
+
+		tasks, err := a.GetTasks(free)
+		a.metrics.polls.Inc()
+		if len(tasks) == 0 {
+			a.metrics.pollMisses.Inc()
+		}
+		if err != nil {
+			logger.Errorf("Failed to get tasks: %v", err)
+			time.Sleep(time.Millisecond * 200)
+		}
+		for _, task := range tasks {
+			jobs <- job{task: task, ctx: a.track(task.ID)}
+		}
+		for i := len(tasks); i < free; i++ {
+			idle <- struct{}{}
+		}
 	}
+}
 
-	wg.Wait()
+func (a *Agent) runWorker(workerID int, jobs <-chan job, idle chan<- struct{}, outcomes chan<- *TaskOutcome) {
+	logger.Infof("Starting worker #%d", workerID)
+
+	for j := range jobs {
+		task := j.task
+		logger.Infof("Worker #%d: Processing task %s: %s %v", workerID, task.ID, task.Operation, task.Args)
+		a.metrics.busyWorkers.Inc()
+		started := time.Now()
+		result, err := SolveTask(j.ctx, task)
+		a.metrics.solveDuration.WithLabelValues(task.Operation).Observe(time.Since(started).Seconds())
+		a.metrics.busyWorkers.Dec()
+		a.untrack(task.ID)
+		idle <- struct{}{}
+
+		if errors.Is(err, context.Canceled) {
+			logger.Infof("Worker #%d: Task %s was cancelled", workerID, task.ID)
+			a.metrics.solved(workerID, outcomeCancelled)
+			continue
+		} else if err != nil {
+			logger.Errorf("Worker #%d: Failed to solve task %s: %v", workerID, task.ID, err)
+			a.metrics.solved(workerID, outcomeFailed)
+			outcomes <- &TaskOutcome{
+				ID:      task.ID,
+				LeaseID: task.LeaseID,
+				Error:   &TaskError{Code: errorCode(err), Message: err.Error()},
+			}
+			continue
+		}
+
+		logger.Infof("Worker #%d: Completed task %s with result %v", workerID, task.ID, result.Result)
+		a.metrics.solved(workerID, outcomeDone)
+		outcomes <- &TaskOutcome{ID: result.ID, LeaseID: result.LeaseID, Result: &result.Result}
+	}
 }
 
-func NewAgent(orchestratorURL string) *Agent {
+// submitOutcomes sends the outcomes of finished tasks, batching those that
+// pile up while a request is in flight.
+func (a *Agent) submitOutcomes(outcomes <-chan *TaskOutcome) {
+	for outcome := range outcomes {
+		batch := []*TaskOutcome{outcome}
+	drain:
+		for len(batch) < maxOutcomeBatch {
+			select {
+			case outcome := <-outcomes:
+				batch = append(batch, outcome)
+			default:
+				break drain
+			}
+		}
+
+		if err := a.SubmitOutcomes(batch); err != nil {
+			logger.Errorf("Failed to submit %d task outcomes: %v", len(batch), err)
+		}
+	}
+}
+
+func NewAgent(orchestratorURL string, computingPower int) *Agent {
 	logger.Infof("Creating new agent with orchestrator URL: %s", orchestratorURL)
-	return &Agent{orchestratorURL: orchestratorURL, client: &http.Client{}}
+	return &Agent{
+		orchestratorURL: orchestratorURL,
+		client:          &http.Client{},
+		computingPower:  computingPower,
+		metrics:         newMetrics(),
+		running:         make(map[string]context.CancelFunc),
+	}
+}
+
+// Register announces the agent to the orchestrator and stores the ID it was
+// given. It is called again whenever the orchestrator no longer knows the
+// agent, e.g. after an eviction or a restart.
+func (a *Agent) Register() error {
+	hostname, _ := os.Hostname()
+	body, err := json.Marshal(&RegisterRequest{Hostname: hostname, ComputingPower: a.computingPower, Version: Version})
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Post(a.orchestratorURL+"/internal/agents/register", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to register agent, status code: %d", resp.StatusCode)
+	}
+
+	var respBody struct {
+		Agent struct {
+			ID string `json:"id"`
+		} `json:"agent"`
+		HeartbeatIntervalMs int64 `json:"heartbeat_interval_ms"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return err
+	}
+
+	a.setRegistration(respBody.Agent.ID, respBody.HeartbeatIntervalMs)
+	return nil
+}
+
+func (a *Agent) setRegistration(id string, heartbeatIntervalMs int64) {
+	a.mu.Lock()
+	a.id = id
+	a.heartbeatInterval = time.Duration(heartbeatIntervalMs) * time.Millisecond
+	a.mu.Unlock()
+
+	logger.Infof("Registered with the orchestrator as %s", id)
+}
+
+// HeartbeatInterval is how often the orchestrator expects heartbeats.
+func (a *Agent) HeartbeatInterval() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.heartbeatInterval <= 0 {
+		return 5 * time.Second
+	}
+	return a.heartbeatInterval
+}
+
+// reregister registers the agent again unless another worker already
+// replaced staleID.
+func (a *Agent) reregister(staleID string) error {
+	a.registerMu.Lock()
+	defer a.registerMu.Unlock()
+
+	if a.ID() != staleID {
+		return nil
+	}
+	logger.Warn("Orchestrator no longer knows this agent, registering again")
+	return a.Register()
+}
+
+func (a *Agent) ID() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.id
+}
+
+func (a *Agent) runHeartbeats() {
+	for {
+		time.Sleep(a.HeartbeatInterval())
+
+		if err := a.Heartbeat(); err != nil {
+			logger.Warnf("Heartbeat failed: %v", err)
+		}
+	}
+}
+
+// Heartbeat tells the orchestrator the agent is alive and aborts the tasks it
+// reports as cancelled.
+func (a *Agent) Heartbeat() error {
+	id := a.ID()
+	resp, err := a.client.Post(a.orchestratorURL+"/internal/agents/"+id+"/heartbeat", "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return a.reregister(id)
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("heartbeat rejected, status code: %d", resp.StatusCode)
+	}
+
+	var respBody struct {
+		Cancelled []string `json:"cancelled"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return err
+	}
+	a.cancelTasks(respBody.Cancelled)
+	return nil
+}
+
+func (a *Agent) track(taskID string) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	a.mu.Lock()
+	a.running[taskID] = cancel
+	a.mu.Unlock()
+	return ctx
+}
+
+func (a *Agent) untrack(taskID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cancel, exists := a.running[taskID]; exists {
+		cancel()
+		delete(a.running, taskID)
+	}
+}
+
+// cancelTasks aborts the given tasks if this agent is solving them.
+func (a *Agent) cancelTasks(taskIDs []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, id := range taskIDs {
+		if cancel, exists := a.running[id]; exists {
+			logger.Infof("Orchestrator cancelled task %s, aborting it", id)
+			cancel()
+		}
+	}
 }
 
 var agentServerOffline bool
 
-func (a *Agent) GetTask() (*Task, error) {
-	resp, err := a.client.Get(a.orchestratorURL + "/internal/task")
+// pollWait is how long the orchestrator may hold a task request open until a
+// task becomes ready.
+const pollWait = 30 * time.Second
+
+// GetTasks fetches up to limit tasks, waiting up to pollWait for the first
+// one. It returns no tasks when the wait elapsed.
+func (a *Agent) GetTasks(limit int) ([]*Task, error) {
+	id := a.ID()
+	query := url.Values{"agent_id": {id}, "max": {strconv.Itoa(limit)}, "wait": {pollWait.String()}}
+	resp, err := a.client.Get(a.orchestratorURL + "/internal/tasks?" + query.Encode())
 	if err != nil {
 		if !agentServerOffline {
 			logger.Warnf("Failed to connect to server at %s. Will retry", a.orchestratorURL)
@@ -75,54 +344,74 @@ func (a *Agent) GetTask() (*Task, error) {
 
 	agentServerOffline = false
 
-	if resp.StatusCode == http.StatusNotFound {
-		logger.Debug("No tasks available")
-		return nil, nil
-	} else if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode == http.StatusGone {
+		return nil, a.reregister(id)
+	}
+	if resp.StatusCode != http.StatusOK {
 		logger.Errorf("Unexpected status code: %d", resp.StatusCode)
-		return nil, errors.New("failed to get task")
+		return nil, errors.New("failed to get tasks")
 	}
 
 	var respBody struct {
-		Task *Task `json:"task"`
+		Tasks     []*Task  `json:"tasks"`
+		Cancelled []string `json:"cancelled"`
 	}
 
 	err = json.NewDecoder(resp.Body).Decode(&respBody)
 	if err != nil {
-		logger.Errorf("Error decoding task JSON: %v", err)
+		logger.Errorf("Error decoding tasks JSON: %v", err)
 		return nil, err
 	}
 
-	jsonTask, err := json.MarshalIndent(respBody.Task, "", "  ")
-	if err != nil {
-		logger.Errorf("Error marshalling task to JSON: %v", err)
-		return nil, err
+	a.cancelTasks(respBody.Cancelled)
+	if len(respBody.Tasks) == 0 {
+		logger.Debug("No tasks available")
+		return nil, nil
 	}
 
-	logger.Infof("Received task: %s", string(jsonTask))
-	return respBody.Task, nil
+	logger.Infof("Received %d tasks", len(respBody.Tasks))
+	return respBody.Tasks, nil
 }
 
-func (a *Agent) SubmitResult(result *TaskResultRequest) error {
-	jsonResult, err := json.Marshal(result)
+// SubmitOutcomes reports the results and failures of several tasks in one
+// request. Outcomes the orchestrator rejects, e.g. for cancelled tasks, are
+// logged and dropped.
+func (a *Agent) SubmitOutcomes(outcomes []*TaskOutcome) error {
+	jsonBody, err := json.Marshal(map[string]interface{}{"results": outcomes})
 	if err != nil {
-		logger.Errorf("Error marshalling result to JSON: %v", err)
+		logger.Errorf("Error marshalling task outcomes to JSON: %v", err)
 		return err
 	}
 
-	resp, err := a.client.Post(a.orchestratorURL+"/internal/task", "application/json", bytes.NewBuffer(jsonResult))
+	resp, err := a.client.Post(a.orchestratorURL+"/internal/tasks/results", "application/json", bytes.NewBuffer(jsonBody))
 	if err != nil {
-		logger.Errorf("Error submitting result: %v", err)
+		logger.Errorf("Error submitting task outcomes: %v", err)
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		logger.Errorf("Unexpected status code when submitting result: %d", resp.StatusCode)
-		return fmt.Errorf("failed to submit result, status code: %d", resp.StatusCode)
+		logger.Errorf("Unexpected status code when submitting task outcomes: %d", resp.StatusCode)
+		return fmt.Errorf("failed to submit task outcomes, status code: %d", resp.StatusCode)
 	}
 
-	logger.Infof("Successfully submitted result for task %s: %v", result.ID, result.Result)
+	var respBody struct {
+		Results []struct {
+			ID     string `json:"id"`
+			Status int    `json:"status"`
+			Error  string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return err
+	}
+
+	for _, result := range respBody.Results {
+		if result.Status != http.StatusOK {
+			logger.Warnf("Orchestrator rejected the outcome of task %s: %s", result.ID, result.Error)
+		}
+	}
+	logger.Infof("Submitted %d task outcomes", len(outcomes))
 	return nil
 }
 
@@ -131,18 +420,22 @@ func getOperationTime(task *Task) time.Duration {
 		return time.Duration(task.OperationTime) * time.Millisecond
 	}
 
-	var envVar string
+	envVar := "TIME_" + strings.ToUpper(task.Operation) + "_MS"
 	switch task.Operation {
 	case "+":
 		envVar = "TIME_ADDITION_MS"
-	case "-":
+	case "-", "neg":
 		envVar = "TIME_SUBTRACTION_MS"
 	case "*":
 		envVar = "TIME_MULTIPLICATIONS_MS"
 	case "/":
 		envVar = "TIME_DIVISIONS_MS"
-	default:
-		return 0
+	case "^":
+		envVar = "TIME_EXPONENTIATION_MS"
+	case "%":
+		envVar = "TIME_MODULO_MS"
+	case "//":
+		envVar = "TIME_INTEGER_DIVISION_MS"
 	}
 
 	if timeStr := os.Getenv(envVar); timeStr != "" {
@@ -154,61 +447,77 @@ func getOperationTime(task *Task) time.Duration {
 	switch task.Operation {
 	case "+":
 		return 100 * time.Millisecond
-	case "-":
+	case "-", "neg":
 		return 100 * time.Millisecond
 	case "*":
 		return 200 * time.Millisecond
-	case "/":
+	case "/", "%", "//":
 		return 300 * time.Millisecond
+	case "^":
+		return 400 * time.Millisecond
 	default:
-		return 0
+		return 200 * time.Millisecond
 	}
 }
 
-func SolveTask(task *Task) (*TaskResultRequest, error) {
-	var num1, num2 float64
-	var err error
-
-	num1, err = convertToFloat(task.Arg1)
+// SolveTask computes the task and waits for its simulated operation time.
+// Cancelling ctx aborts the wait and returns ctx.Err(). The work is traced as
+// a child of the task span on the orchestrator.
+func SolveTask(ctx context.Context, task *Task) (*TaskResultRequest, error) {
+	ctx, span := tracer.Start(tracing.Extract(ctx, task.TraceParent), "SolveTask", trace.WithAttributes(
+		attribute.String("task.id", task.ID),
+		attribute.String("task.operation", task.Operation),
+	))
+	defer span.End()
+
+	result, err := solveTask(ctx, task)
 	if err != nil {
-		return nil, fmt.Errorf("failed to convert Arg1: %v", err)
+		span.SetStatus(codes.Error, err.Error())
 	}
+	return result, err
+}
 
-	num2, err = convertToFloat(task.Arg2)
-	if err != nil {
-		return nil, fmt.Errorf("failed to convert Arg2: %v", err)
+func solveTask(ctx context.Context, task *Task) (*TaskResultRequest, error) {
+	args := make([]float64, 0, len(task.Args))
+	for i, arg := range task.Args {
+		num, err := convertToFloat(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to convert argument %d: %v", errs.ErrInvalidNumber, i+1, err)
+		}
+		args = append(args, num)
 	}
 
-	logger.Debugf("Solving task: %v %s %v", num1, task.Operation, num2)
+	logger.Debugf("Solving task: %s %v", task.Operation, args)
 
 	operationTime := getOperationTime(task)
 	logger.Debugf("Operation %s will take %v", task.Operation, operationTime)
 
-	var result float64
-	switch task.Operation {
-	case "+":
-		time.Sleep(operationTime)
-		result = num1 + num2
-	case "-":
-		time.Sleep(operationTime)
-		result = num1 - num2
-	case "*":
-		time.Sleep(operationTime)
-		result = num1 * num2
-	case "/":
-		if num2 == 0 {
-			logger.Errorf("Division by zero in task %s", task.ID)
-			return nil, errors.New("division by zero")
-		}
-		time.Sleep(operationTime)
-		result = num1 / num2
-	default:
-		logger.Errorf("Unsupported operation in task %s: %s", task.ID, task.Operation)
-		return nil, errors.New("unsupported operation")
+	result, err := calc.Apply(task.Operation, args)
+	if err != nil {
+		logger.Errorf("Task %s failed: %v", task.ID, err)
+		return nil, err
+	}
+	select {
+	case <-time.After(operationTime):
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 
 	logger.Debugf("Task %s result: %v", task.ID, result)
-	return &TaskResultRequest{ID: task.ID, Result: result}, nil
+	return &TaskResultRequest{ID: task.ID, LeaseID: task.LeaseID, Result: result}, nil
+}
+
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, calc.ErrDivisionByZero):
+		return ErrorCodeDivisionByZero
+	case errors.Is(err, calc.ErrUnsupportedOperation):
+		return ErrorCodeUnsupportedOperation
+	case errors.Is(err, calc.ErrInvalidResult):
+		return ErrorCodeInvalidResult
+	default:
+		return ErrorCodeInvalidArgument
+	}
 }
 
 func convertToFloat(value interface{}) (float64, error) {
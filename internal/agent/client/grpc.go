@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "distr-comp/internal/agentpb"
+	"distr-comp/internal/logger"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// runGRPC drives the worker pool over a gRPC stream, reconnecting whenever
+// the stream breaks. It only returns when the very first connection fails, so
+// that the caller can fall back to HTTP.
+func (a *Agent) runGRPC(addr string, jobs chan<- job, idle chan struct{}, outcomes <-chan *TaskOutcome) error {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	client := pb.NewAgentServiceClient(conn)
+
+	connected := false
+	for {
+		err := a.serveStream(client, jobs, idle, outcomes, &connected)
+		if !connected {
+			conn.Close()
+			return err
+		}
+		logger.Warnf("gRPC stream to %s ended, reconnecting: %v", addr, err)
+		time.Sleep(time.Second)
+	}
+}
+
+// serveStream runs one Connect stream until it fails. connected is set once
+// the orchestrator has accepted the agent.
+func (a *Agent) serveStream(client pb.AgentServiceClient, jobs chan<- job, idle chan struct{}, outcomes <-chan *TaskOutcome, connected *bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	hello := &pb.Hello{Hostname: hostname, ComputingPower: int32(a.computingPower), Version: Version}
+	if err := stream.Send(&pb.AgentMessage{Body: &pb.AgentMessage_Hello{Hello: hello}}); err != nil {
+		return err
+	}
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	welcome := msg.GetWelcome()
+	if welcome == nil {
+		return errors.New("orchestrator did not answer hello with welcome")
+	}
+	a.setRegistration(welcome.AgentId, welcome.HeartbeatIntervalMs)
+	*connected = true
+
+	var sendMu sync.Mutex
+	send := func(msg *pb.AgentMessage) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(msg)
+	}
+
+	// outstanding counts idle tokens granted as credits that no task has
+	// used yet. They are given back to the pool when the stream ends.
+	var outstanding atomic.Int32
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-idle:
+			case <-ctx.Done():
+				return
+			}
+			credit := int32(1)
+		drain:
+			for {
+				select {
+				case <-idle:
+					credit++
+				default:
+					break drain
+				}
+			}
+			outstanding.Add(credit)
+			if err := send(&pb.AgentMessage{Body: &pb.AgentMessage_Credit{Credit: &pb.Credit{Tasks: credit}}}); err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case outcome := <-outcomes:
+				if err := send(&pb.AgentMessage{Body: &pb.AgentMessage_Outcome{Outcome: outcomeToPB(outcome)}}); err != nil {
+					logger.Errorf("Failed to submit the outcome of task %s: %v", outcome.ID, err)
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(a.HeartbeatInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := send(&pb.AgentMessage{Body: &pb.AgentMessage_Heartbeat{Heartbeat: &pb.Heartbeat{}}}); err != nil {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	err = a.receiveStream(stream, jobs, &outstanding)
+	cancel()
+	wg.Wait()
+	for i := outstanding.Load(); i > 0; i-- {
+		idle <- struct{}{}
+	}
+	return err
+}
+
+func (a *Agent) receiveStream(stream pb.AgentService_ConnectClient, jobs chan<- job, outstanding *atomic.Int32) error {
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		switch body := msg.Body.(type) {
+		case *pb.OrchestratorMessage_Task:
+			outstanding.Add(-1)
+			task := taskFromPB(body.Task)
+			logger.Infof("Received task %s", task.ID)
+			jobs <- job{task: task, ctx: a.track(task.ID)}
+		case *pb.OrchestratorMessage_Cancel:
+			a.cancelTasks(body.Cancel.TaskIds)
+		default:
+			return fmt.Errorf("unexpected message %T", body)
+		}
+	}
+}
+
+func taskFromPB(t *pb.Task) *Task {
+	args := make([]interface{}, 0, len(t.Args))
+	for _, arg := range t.Args {
+		args = append(args, arg)
+	}
+	return &Task{
+		ID:            t.Id,
+		LeaseID:       t.LeaseId,
+		Args:          args,
+		Operation:     t.Operation,
+		OperationTime: int(t.OperationTime),
+		TraceParent:   t.TraceParent,
+	}
+}
+
+func outcomeToPB(outcome *TaskOutcome) *pb.TaskOutcome {
+	msg := &pb.TaskOutcome{Id: outcome.ID, LeaseId: outcome.LeaseID}
+	if outcome.Error != nil {
+		msg.Outcome = &pb.TaskOutcome_Error{Error: &pb.TaskError{Code: outcome.Error.Code, Message: outcome.Error.Message}}
+	} else if outcome.Result != nil {
+		msg.Outcome = &pb.TaskOutcome_Result{Result: *outcome.Result}
+	}
+	return msg
+}
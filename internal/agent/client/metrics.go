@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"net/http"
+	"strconv"
+
+	"distr-comp/internal/logger"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "distrcomp_agent"
+
+// Outcomes of solved tasks, as counted in the tasks_total metric.
+const (
+	outcomeDone      = "done"
+	outcomeFailed    = "failed"
+	outcomeCancelled = "cancelled"
+)
+
+type metrics struct {
+	registry *prometheus.Registry
+
+	tasks         *prometheus.CounterVec
+	solveDuration *prometheus.HistogramVec
+	busyWorkers   prometheus.Gauge
+	polls         prometheus.Counter
+	pollMisses    prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		tasks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tasks_total",
+			Help:      "Tasks solved by each worker, by outcome: done, failed or cancelled.",
+		}, []string{"worker", "outcome"}),
+		solveDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "solve_duration_seconds",
+			Help:      "Time SolveTask took, by operation.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+		}, []string{"operation"}),
+		busyWorkers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "busy_workers",
+			Help:      "Workers solving a task right now.",
+		}),
+		polls: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "polls_total",
+			Help:      "Task requests sent to the orchestrator over HTTP.",
+		}),
+		pollMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "poll_misses_total",
+			Help:      "Task requests that returned no task, because the wait elapsed or the request failed.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.tasks, m.solveDuration, m.busyWorkers, m.polls, m.pollMisses,
+	)
+	return m
+}
+
+// ServeMetrics exposes the agent metrics at /metrics on addr. It returns when
+// the listener fails.
+func (a *Agent) ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(a.metrics.registry, promhttp.HandlerOpts{}))
+	logger.Infof("Serving metrics on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func (m *metrics) solved(workerID int, outcome string) {
+	m.tasks.WithLabelValues(strconv.Itoa(workerID), outcome).Inc()
+}
@@ -1,21 +1,91 @@
 package agent
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Version is reported to the orchestrator on registration. It is set at
+// build time with -ldflags "-X distr-comp/internal/agent/client.Version=...".
+var Version = "dev"
+
+// Transports an agent can fetch tasks over.
+const (
+	TransportHTTP = "http"
+	TransportGRPC = "grpc"
+)
+
+type Config struct {
+	ComputingPower  int
+	OrchestratorURL string
+	// Transport is TransportHTTP or TransportGRPC. GRPCAddr is the
+	// orchestrator's gRPC address, used with TransportGRPC.
+	Transport string
+	GRPCAddr  string
+	// MetricsAddr is where the agent serves its Prometheus metrics; empty
+	// disables them.
+	MetricsAddr string
+}
 
 type Agent struct {
 	orchestratorURL string
 	client          *http.Client
+	computingPower  int
+	metrics         *metrics
+
+	// id is assigned by the orchestrator on registration, guarded by mu.
+	// registerMu keeps workers from registering the agent several times.
+	id                string
+	heartbeatInterval time.Duration
+	registerMu        sync.Mutex
+
+	// running holds the cancel functions of the tasks being solved, so that
+	// tasks the orchestrator reports as cancelled can be aborted.
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
 }
 
 type Task struct {
-	ID            string      `json:"id"`
-	Arg1          interface{} `json:"arg1"`
-	Arg2          interface{} `json:"arg2"`
-	Operation     string      `json:"operation"`
-	OperationTime int         `json:"operation_time"`
+	ID            string        `json:"id"`
+	LeaseID       string        `json:"lease_id"`
+	Args          []interface{} `json:"args"`
+	Operation     string        `json:"operation"`
+	OperationTime int           `json:"operation_time"`
+	// TraceParent is the trace context of the task span on the
+	// orchestrator; SolveTask continues that trace.
+	TraceParent string `json:"trace_parent,omitempty"`
+}
+
+type RegisterRequest struct {
+	Hostname       string `json:"hostname"`
+	ComputingPower int    `json:"computing_power"`
+	Version        string `json:"version"`
 }
 
 type TaskResultRequest struct {
-	ID     string  `json:"id"`
-	Result float64 `json:"result"`
+	ID      string  `json:"id"`
+	LeaseID string  `json:"lease_id"`
+	Result  float64 `json:"result"`
+}
+
+// TaskOutcome reports a finished task: either Result or Error is set.
+type TaskOutcome struct {
+	ID      string     `json:"id"`
+	LeaseID string     `json:"lease_id"`
+	Result  *float64   `json:"result,omitempty"`
+	Error   *TaskError `json:"error,omitempty"`
 }
+
+type TaskError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	ErrorCodeDivisionByZero       = "division_by_zero"
+	ErrorCodeUnsupportedOperation = "unsupported_operation"
+	ErrorCodeInvalidArgument      = "invalid_argument"
+	ErrorCodeInvalidResult        = "invalid_result"
+)
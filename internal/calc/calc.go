@@ -0,0 +1,113 @@
+// Package calc implements the elementary operations of the system. Agents use
+// it to solve tasks and the orchestrator uses it to evaluate cheap operations
+// locally.
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	ErrDivisionByZero       = errors.New("division by zero")
+	ErrUnsupportedOperation = errors.New("unsupported operation")
+	ErrArgumentCount        = errors.New("wrong number of arguments")
+	ErrInvalidResult        = errors.New("result is not a finite number")
+)
+
+const variadic = -1
+
+type operation struct {
+	minArgs int
+	maxArgs int
+	apply   func(args []float64) (float64, error)
+}
+
+// Apply computes op over args. Besides the errors of the operation itself it
+// fails with ErrUnsupportedOperation, ErrArgumentCount or ErrInvalidResult when
+// the result is NaN or infinite.
+func Apply(op string, args []float64) (float64, error) {
+	operation, exists := operations[op]
+	if !exists {
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedOperation, op)
+	}
+	if len(args) < operation.minArgs || (operation.maxArgs != variadic && len(args) > operation.maxArgs) {
+		return 0, fmt.Errorf("%w: %s does not accept %d arguments", ErrArgumentCount, op, len(args))
+	}
+
+	result, err := operation.apply(args)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, fmt.Errorf("%w: %s%v = %v", ErrInvalidResult, op, args, result)
+	}
+	return result, nil
+}
+
+// operations is the registry of everything that can be computed: the binary
+// operators, negation and the built-in functions.
+var operations = map[string]operation{
+	"+": binary(func(a, b float64) (float64, error) { return a + b, nil }),
+	"-": binary(func(a, b float64) (float64, error) { return a - b, nil }),
+	"*": binary(func(a, b float64) (float64, error) { return a * b, nil }),
+	"/": binary(func(a, b float64) (float64, error) {
+		if b == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return a / b, nil
+	}),
+	"%": binary(func(a, b float64) (float64, error) {
+		if b == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return math.Mod(a, b), nil
+	}),
+	"//": binary(func(a, b float64) (float64, error) {
+		if b == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return math.Floor(a / b), nil
+	}),
+	"^":   binary(func(a, b float64) (float64, error) { return math.Pow(a, b), nil }),
+	"neg": unary(func(a float64) float64 { return -a }),
+
+	"sqrt": unary(math.Sqrt),
+	"sin":  unary(math.Sin),
+	"cos":  unary(math.Cos),
+	"abs":  unary(math.Abs),
+	"log": {minArgs: 1, maxArgs: 2, apply: func(args []float64) (float64, error) {
+		if len(args) == 2 {
+			return math.Log(args[0]) / math.Log(args[1]), nil
+		}
+		return math.Log(args[0]), nil
+	}},
+	"min": {minArgs: 1, maxArgs: variadic, apply: func(args []float64) (float64, error) {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Min(result, arg)
+		}
+		return result, nil
+	}},
+	"max": {minArgs: 1, maxArgs: variadic, apply: func(args []float64) (float64, error) {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Max(result, arg)
+		}
+		return result, nil
+	}},
+	"pow": binary(func(a, b float64) (float64, error) { return math.Pow(a, b), nil }),
+}
+
+func unary(fn func(float64) float64) operation {
+	return operation{minArgs: 1, maxArgs: 1, apply: func(args []float64) (float64, error) {
+		return fn(args[0]), nil
+	}}
+}
+
+func binary(fn func(a, b float64) (float64, error)) operation {
+	return operation{minArgs: 2, maxArgs: 2, apply: func(args []float64) (float64, error) {
+		return fn(args[0], args[1])
+	}}
+}
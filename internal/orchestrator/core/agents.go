@@ -0,0 +1,146 @@
+package orchestrator
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	logger "distr-comp/internal/logger"
+	errs "distr-comp/internal/orchestrator/errors"
+	types "distr-comp/internal/orchestrator/types"
+)
+
+// RegisterAgent adds an agent to the fleet and returns it with its new ID.
+// The agent must then send heartbeats at least every HeartbeatInterval.
+func (o *Orchestrator) RegisterAgent(hostname string, computingPower int, version string) (*types.Agent, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	o.Mu.Lock()
+	defer o.Mu.Unlock()
+
+	now := time.Now()
+	agent := &types.Agent{
+		ID:             "agent-" + hex.EncodeToString(id),
+		Hostname:       hostname,
+		ComputingPower: computingPower,
+		Version:        version,
+		RegisteredAt:   now,
+		LastSeen:       now,
+	}
+	o.Agents[agent.ID] = agent
+	o.ComputingPower += computingPower
+
+	logger.Infof("Agent %s registered from %s with computing power %d (version %s)",
+		agent.ID, hostname, computingPower, version)
+	return agent, nil
+}
+
+// HeartbeatInterval is how often agents must report that they are alive.
+func (o *Orchestrator) HeartbeatInterval() time.Duration {
+	return o.AgentTimeout / 3
+}
+
+// Heartbeat records that the agent is alive and returns the cancelled tasks
+// it should stop working on.
+func (o *Orchestrator) Heartbeat(agentID string, now time.Time) ([]string, error) {
+	o.Mu.Lock()
+	defer o.Mu.Unlock()
+
+	agent, exists := o.Agents[agentID]
+	if !exists {
+		return nil, errs.ErrAgentNotFound
+	}
+	agent.LastSeen = now
+	return o.cancelledTaskIDs(agentID, now), nil
+}
+
+// touchAgent marks a registered agent as seen. An empty ID stands for an
+// anonymous agent. The caller must hold o.Mu.
+func (o *Orchestrator) touchAgent(agentID string, now time.Time) error {
+	if agentID == "" {
+		return nil
+	}
+	agent, exists := o.Agents[agentID]
+	if !exists {
+		return errs.ErrAgentNotFound
+	}
+	agent.LastSeen = now
+	return nil
+}
+
+// AgentTasks returns the IDs of the tasks the agent is working on. The caller
+// must hold o.Mu.
+func (o *Orchestrator) AgentTasks(agentID string) []string {
+	tasks := make([]string, 0)
+	for id := range o.ProcessingTasks {
+		if task, exists := o.Tasks[id]; exists && task.AgentID == agentID {
+			tasks = append(tasks, id)
+		}
+	}
+	return tasks
+}
+
+// EvictAgents removes agents that missed their heartbeats and puts their
+// tasks back on the ready queue without waiting for the leases to expire. It
+// returns how many agents were evicted.
+func (o *Orchestrator) EvictAgents(now time.Time) int {
+	o.Mu.Lock()
+	defer o.Mu.Unlock()
+
+	evicted := 0
+	for id, agent := range o.Agents {
+		if now.Sub(agent.LastSeen) < o.AgentTimeout {
+			continue
+		}
+
+		requeued := o.removeAgent(agent)
+		evicted++
+		logger.Warnf("Agent %s missed its heartbeats, evicted it and re-queued %d tasks", id, requeued)
+	}
+	return evicted
+}
+
+// DisconnectAgent removes an agent whose connection ended and re-queues its
+// tasks.
+func (o *Orchestrator) DisconnectAgent(agentID string) {
+	o.Mu.Lock()
+	defer o.Mu.Unlock()
+
+	if agent, exists := o.Agents[agentID]; exists {
+		requeued := o.removeAgent(agent)
+		logger.Infof("Agent %s disconnected, re-queued %d tasks", agentID, requeued)
+	}
+}
+
+// removeAgent drops the agent from the fleet and puts its tasks back on the
+// ready queue, returning how many there were. The caller must hold o.Mu.
+func (o *Orchestrator) removeAgent(agent *types.Agent) int {
+	var requeued []*types.Task
+	for _, taskID := range o.AgentTasks(agent.ID) {
+		task := o.Tasks[taskID]
+		o.endTaskSpan(task, "agent removed")
+		task.LeaseID = ""
+		task.LeaseDeadline = time.Time{}
+		delete(o.ProcessingTasks, taskID)
+		o.enqueueReady(task)
+		requeued = append(requeued, task)
+	}
+	o.persist(nil, requeued)
+
+	delete(o.Agents, agent.ID)
+	o.ComputingPower -= agent.ComputingPower
+	return len(requeued)
+}
+
+// capacity returns the number of tasks the agents can run at once: the sum
+// over registered agents, or the configured AgentCapacity when none is
+// registered.
+func (o *Orchestrator) capacity() int {
+	if o.ComputingPower > 0 {
+		return o.ComputingPower
+	}
+	return o.AgentCapacity
+}
@@ -1,19 +1,29 @@
 package orchestrator
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"math"
+	"net/netip"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"unicode"
 
+	"distr-comp/internal/calc"
 	logger "distr-comp/internal/logger"
 	errs "distr-comp/internal/orchestrator/errors"
+	store "distr-comp/internal/orchestrator/store"
 	types "distr-comp/internal/orchestrator/types"
 	utils "distr-comp/internal/orchestrator/utils"
+	"distr-comp/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -21,186 +31,907 @@ const (
 	TokenOperator
 	TokenLeftParen
 	TokenRightParen
+	TokenFunction
+	TokenComma
+	TokenIdentifier
+
+	StatusPending   = "pending"
+	StatusReady     = "ready"
+	StatusProgress  = "in_progress"
+	StatusDone      = "done"
+	StatusError     = "error"
+	StatusCancelled = "cancelled"
+
+	// OperationNegate is the task operation for unary minus applied to a
+	// non-literal operand. It takes a single argument.
+	OperationNegate = "neg"
+
+	// ErrorCodeDeadlineExceeded is the error code of expressions that did
+	// not finish before their deadline.
+	ErrorCodeDeadlineExceeded = "deadline_exceeded"
+
+	// leaseGracePeriod is added on top of the operation time so that network
+	// round-trips don't cause healthy agents to lose their tasks.
+	leaseGracePeriod    = 5 * time.Second
+	leaseReaperInterval = time.Second
+
+	defaultAgentTimeout = 15 * time.Second
 
-	StatusPending  = "pending"
-	StatusReady    = "ready"
-	StatusProgress = "in_progress"
-	StatusDone     = "done"
-	StatusError    = "error"
+	operatorChars = "+-*/^%"
 )
 
+const variadic = -1
+
+// functions lists the built-in functions with the number of arguments each
+// accepts. Every function becomes a single task with all its arguments.
+var functions = map[string]struct{ minArgs, maxArgs int }{
+	"sqrt": {1, 1},
+	"sin":  {1, 1},
+	"cos":  {1, 1},
+	"log":  {1, 2},
+	"abs":  {1, 1},
+	"min":  {1, variadic},
+	"max":  {1, variadic},
+	"pow":  {2, 2},
+}
+
+// Config holds the tunables of an orchestrator.
+type Config struct {
+	// OperationTimes maps every operator ("+", "-", "*", "/", "^", "%", "//")
+	// and built-in function ("sqrt", "max", ...) to its simulated duration in
+	// milliseconds. Negation defaults to the subtraction time.
+	OperationTimes map[string]time.Duration
+	// LocalEvalThreshold is the operation time, in milliseconds, below which
+	// the orchestrator evaluates an operation itself instead of dispatching it
+	// to an agent. Zero disables local evaluation.
+	LocalEvalThreshold time.Duration
+	// SchedulingPolicy selects how agents are shared between expressions:
+	// PolicyRoundRobin, PolicyWeighted or PolicyEDF. Empty means
+	// PolicyWeighted.
+	SchedulingPolicy string
+	// AgentCapacity is the number of tasks the agents can run at once. It is
+	// used to reject expressions whose deadline cannot be met; zero means
+	// unknown.
+	AgentCapacity int
+	// AgentTimeout is how long an agent may stay silent before it is
+	// evicted and its tasks are re-queued. Zero means 15 seconds.
+	AgentTimeout time.Duration
+	// WebhookSecret signs the webhooks sent to callback URLs. Empty means
+	// they are sent unsigned.
+	WebhookSecret string
+	// WebhookAllowedNetworks lists the internal networks callback URLs may
+	// point to; loopback, private and link-local addresses are refused
+	// otherwise.
+	WebhookAllowedNetworks []netip.Prefix
+}
+
 type Orchestrator struct {
-	Expressions       map[string]*types.Expression
-	Tasks             map[string]*types.Task
-	ReadyTasks        chan *types.Task
-	ProcessingTasks   map[string]bool
-	OperationTimes    map[string]time.Duration
+	Expressions map[string]*types.Expression
+	// byCreation indexes Expressions by creation time and byStatus does the
+	// same for each status, see ListExpressions.
+	byCreation []*types.Expression
+	byStatus   map[string][]*types.Expression
+	// deadlines holds the expressions with a deadline that has not passed
+	// yet, see ExpireDeadlines.
+	deadlines          deadlineHeap
+	Tasks              map[string]*types.Task
+	Scheduler          Scheduler
+	ProcessingTasks    map[string]bool
+	OperationTimes     map[string]time.Duration
+	LocalEvalThreshold time.Duration
+	// ComputingPower is the sum of the computing power of registered agents.
 	ComputingPower    int
+	AgentCapacity     int
+	AgentTimeout      time.Duration
+	Agents            map[string]*types.Agent
+	Store             store.Store
 	Mu                sync.RWMutex
 	ExpressionCounter int
 	TaskCounter       int
+	LeaseCounter      int
+	Formulas          map[string]*types.Formula
+	FormulaCounter    int
+	// CancelledTasks maps tasks that were cancelled while an agent held them
+	// to the deadline of that lease. Agents learn about them when they poll
+	// and stop working on them.
+	CancelledTasks map[string]time.Time
+	// Deliveries is the webhook outbox.
+	Deliveries      map[string]*types.Delivery
+	DeliveryCounter int
+	WebhookSecret   string
+	// webhookAllowedNetworks is Config.WebhookAllowedNetworks.
+	webhookAllowedNetworks []netip.Prefix
+
+	// Events publishes expression status changes and task completions.
+	Events *EventBus
+
+	metrics *metrics
+	// taskSpans holds the open span of every leased task.
+	taskSpans map[string]trace.Span
+
+	// taskReady is closed and replaced whenever a task is queued, waking up
+	// agents waiting in WaitNextTask.
+	taskReady chan struct{}
+
+	// unsavedDeliveries are queued webhooks the next persist saves.
+	unsavedDeliveries []*types.Delivery
+	webhookWake       chan struct{}
 }
 
-func NewOrchestrator(timeAddition, timeSubtraction, timeMultiplication, timeDivision time.Duration) *Orchestrator {
-	logger.Infof("Initializing new orchestrator with operation times: +=%v, -=%v, *=%v, /=%v",
-		timeAddition, timeSubtraction, timeMultiplication, timeDivision)
+func NewOrchestrator(cfg Config, st store.Store) (*Orchestrator, error) {
+	// The config may be shared, e.g. by tests, and is not ours to change.
+	operationTimes := make(map[string]time.Duration, len(cfg.OperationTimes)+1)
+	maps.Copy(operationTimes, cfg.OperationTimes)
+	if _, exists := operationTimes[OperationNegate]; !exists {
+		operationTimes[OperationNegate] = operationTimes["-"]
+	}
+	agentTimeout := cfg.AgentTimeout
+	if agentTimeout <= 0 {
+		agentTimeout = defaultAgentTimeout
+	}
+
+	policy := cfg.SchedulingPolicy
+	if policy == "" {
+		policy = PolicyWeighted
+	}
+	scheduler, err := NewScheduler(policy)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Initializing new orchestrator with operation times: %v, local evaluation threshold: %v, scheduling policy: %s",
+		operationTimes, cfg.LocalEvalThreshold, policy)
+
+	o := &Orchestrator{
+		Expressions:            make(map[string]*types.Expression),
+		byStatus:               make(map[string][]*types.Expression),
+		Tasks:                  make(map[string]*types.Task),
+		Scheduler:              scheduler,
+		ProcessingTasks:        make(map[string]bool),
+		OperationTimes:         operationTimes,
+		LocalEvalThreshold:     cfg.LocalEvalThreshold,
+		AgentCapacity:          cfg.AgentCapacity,
+		AgentTimeout:           agentTimeout,
+		Agents:                 make(map[string]*types.Agent),
+		Formulas:               make(map[string]*types.Formula),
+		CancelledTasks:         make(map[string]time.Time),
+		Deliveries:             make(map[string]*types.Delivery),
+		WebhookSecret:          cfg.WebhookSecret,
+		webhookAllowedNetworks: cfg.WebhookAllowedNetworks,
+		Events:                 NewEventBus(),
+		metrics:                newMetrics(),
+		taskSpans:              make(map[string]trace.Span),
+		taskReady:              make(chan struct{}),
+		webhookWake:            make(chan struct{}, 1),
+		Store:                  st,
+	}
 
-	return &Orchestrator{
-		Expressions:     make(map[string]*types.Expression),
-		Tasks:           make(map[string]*types.Task),
-		ReadyTasks:      make(chan *types.Task, 8192),
-		ProcessingTasks: make(map[string]bool),
-		OperationTimes: map[string]time.Duration{
-			"+": timeAddition,
-			"-": timeSubtraction,
-			"*": timeMultiplication,
-			"/": timeDivision,
-		},
+	if err := o.restore(); err != nil {
+		return nil, err
 	}
+
+	go o.runLeaseReaper(leaseReaperInterval)
+	go o.runWebhooks()
+	return o, nil
 }
 
-func (o *Orchestrator) AddExpression(expr string) (string, error) {
+// restore reloads the state saved in the store. Tasks that were in progress
+// when the orchestrator stopped lost their agents, so they go back to the
+// ready queue together with the tasks that were already ready.
+func (o *Orchestrator) restore() error {
+	ctx, span := tracer.Start(context.Background(), "restore")
+	defer span.End()
+
+	records, err := o.Store.Load()
+	if err != nil {
+		return fmt.Errorf("load orchestrator state: %w", err)
+	}
+
+	if records.Counters != nil {
+		o.ExpressionCounter = records.Counters.Expressions
+		o.TaskCounter = records.Counters.Tasks
+		o.LeaseCounter = records.Counters.Leases
+		o.FormulaCounter = records.Counters.Formulas
+		o.DeliveryCounter = records.Counters.Deliveries
+	}
+	for _, delivery := range records.Deliveries {
+		o.Deliveries[delivery.ID] = delivery
+	}
+	for _, formula := range records.Formulas {
+		rpn, err := compile(ctx, formula.Expression)
+		if err != nil {
+			logger.Errorf("Failed to recompile formula %s, skipping it: %v", formula.ID, err)
+			continue
+		}
+		formula.RPN = rpn
+		o.Formulas[formula.ID] = formula
+	}
+	for _, task := range records.Tasks {
+		task.Seq = parseSeq(task.ID)
+		o.Tasks[task.ID] = task
+	}
+
+	requeued := 0
+	for _, expr := range records.Expressions {
+		expr.Seq = parseSeq(expr.ID)
+		o.Expressions[expr.ID] = expr
+		o.byCreation = append(o.byCreation, expr)
+		if expr.Status != StatusPending {
+			continue
+		}
+		o.trackDeadline(expr)
+
+		for _, task := range expr.Tasks {
+			if task.Status == StatusPending {
+				for _, dep := range task.Dependencies {
+					if t, exists := o.Tasks[dep]; exists && t.Status == StatusDone {
+						task.Dependencies = utils.Remove(task.Dependencies, dep)
+					}
+				}
+				if len(task.Dependencies) > 0 {
+					continue
+				}
+			}
+
+			switch task.Status {
+			case StatusPending, StatusReady, StatusProgress:
+				task.LeaseID = ""
+				task.LeaseDeadline = time.Time{}
+				o.enqueueReady(task)
+				requeued++
+			}
+		}
+	}
+
+	sort.Slice(o.byCreation, func(i, j int) bool { return olderThan(o.byCreation[i], o.byCreation[j]) })
+	for _, expr := range o.byCreation {
+		o.byStatus[expr.Status] = append(o.byStatus[expr.Status], expr)
+	}
+
+	logger.Infof("Restored %d expressions and %d tasks, %d tasks re-queued, %d webhooks to deliver",
+		len(records.Expressions), len(records.Tasks), requeued, len(records.Deliveries))
+	return nil
+}
+
+// persist saves the given objects together with the ID counters and the
+// webhooks queued since the last save. The store only encodes them here and
+// writes them in the background, so o.Mu is not held for the disk. Storage
+// failures, which may surface on a later save, are logged rather than returned: the in-memory state is
+// already updated and stays authoritative until the next successful save.
+func (o *Orchestrator) persist(exprs []*types.Expression, tasks []*types.Task) {
+	o.persistRecords(store.Records{Expressions: exprs, Tasks: tasks})
+}
+
+func (o *Orchestrator) persistRecords(records store.Records) {
+	records.Counters = &store.Counters{
+		Expressions: o.ExpressionCounter,
+		Tasks:       o.TaskCounter,
+		Leases:      o.LeaseCounter,
+		Formulas:    o.FormulaCounter,
+		Deliveries:  o.DeliveryCounter,
+	}
+	queued := len(o.unsavedDeliveries) > 0
+	records.Deliveries = append(records.Deliveries, o.unsavedDeliveries...)
+	o.unsavedDeliveries = nil
+	if err := o.Store.Save(records); err != nil {
+		logger.Errorf("Failed to persist orchestrator state: %v", err)
+	}
+	if queued {
+		o.wakeWebhooks()
+	}
+}
+
+// enqueueReady puts the task on the ready queue. ReadyAt restarts on every
+// (re)queue, so time lost on an agent that dropped the task is not counted
+// as queueing.
+func (o *Orchestrator) enqueueReady(task *types.Task) {
+	now := time.Now()
+	task.Status = StatusReady
+	task.ReadyAt = &now
+	if expr, exists := o.Expressions[task.ExpressionID]; exists {
+		o.Scheduler.Push(task, expr)
+		close(o.taskReady)
+		o.taskReady = make(chan struct{})
+	}
+}
+
+// ExpressionOptions are the per-request settings of a submitted expression.
+type ExpressionOptions struct {
+	// Variables binds the identifiers used in the expression; it may be nil
+	// when there are none.
+	Variables map[string]float64
+	// StrictOrder keeps the left-to-right evaluation order of "+" and "*"
+	// chains instead of rebalancing them for parallelism.
+	StrictOrder bool
+	// Priority raises the share of agents the expression gets; the default
+	// is 0. It must be between 0 and MaxPriority.
+	Priority int
+	// Deadline, when set, is the time by which the expression must be done.
+	// Expressions that cannot make it are rejected, and ones that miss it
+	// while running fail with ErrorCodeDeadlineExceeded.
+	Deadline *time.Time
+	// CallbackURL, when set, receives the final ExpressionResponse of the
+	// expression as a signed POST.
+	CallbackURL string
+}
+
+// AddExpression compiles the expression into tasks and queues the ones that
+// can start right away. Compilation errors wrap errs.ErrInvalidExpression.
+// The tasks are traced as children of the span in ctx.
+func (o *Orchestrator) AddExpression(ctx context.Context, expr string, opts ExpressionOptions) (string, error) {
 	o.Mu.Lock()
 	defer o.Mu.Unlock()
 
-	o.ExpressionCounter++
-	exprID := fmt.Sprintf("expr-%d", o.ExpressionCounter)
+	rpn, err := compile(ctx, expr)
+	if err != nil {
+		return "", err
+	}
 
-	tokens, err := tokenize(expr)
+	expression, err := o.instantiate(ctx, rpn, opts, "")
 	if err != nil {
 		return "", err
 	}
+	return expression.ID, nil
+}
+
+// compile turns the source expression into RPN. Errors wrap
+// errs.ErrInvalidExpression.
+func compile(ctx context.Context, expr string) ([]types.Token, error) {
+	_, span := tracer.Start(ctx, "tokenize")
+	tokens, err := tokenize(expr)
+	span.End()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errs.ErrInvalidExpression, err)
+	}
+
+	_, span = tracer.Start(ctx, "rpn")
 	rpn, err := toRPN(tokens)
+	span.End()
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("%w: %w", errs.ErrInvalidExpression, err)
+	}
+	return rpn, nil
+}
+
+// instantiate builds a new expression with its tasks from compiled RPN and
+// queues the tasks that can start right away. formulaID is empty for
+// expressions submitted directly. The caller must hold o.Mu.
+func (o *Orchestrator) instantiate(ctx context.Context, rpn []types.Token, opts ExpressionOptions, formulaID string) (*types.Expression, error) {
+	_, span := tracer.Start(ctx, "build graph")
+	defer span.End()
+
+	tree, err := buildTree(rpn, opts.Variables)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errs.ErrInvalidExpression, err)
+	}
+	if !opts.StrictOrder {
+		o.rebalance(tree)
+	}
+	folded := o.foldConstants(tree)
+
+	if opts.Priority < 0 || opts.Priority > MaxPriority {
+		return nil, fmt.Errorf("%w %d, must be between 0 and %d", errs.ErrInvalidPriority, opts.Priority, MaxPriority)
+	}
+	if opts.CallbackURL != "" {
+		if err := o.validateCallbackURL(opts.CallbackURL); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Deadline != nil {
+		estimate := o.estimateDuration(tree, o.capacity()) * time.Millisecond
+		if finish := time.Now().Add(estimate); finish.After(*opts.Deadline) {
+			return nil, fmt.Errorf("%w: needs at least %v, finishing at %s after deadline %s",
+				errs.ErrDeadlineUnreachable, estimate, finish.Format(time.RFC3339Nano), opts.Deadline.Format(time.RFC3339Nano))
+		}
 	}
 
+	o.ExpressionCounter++
+	exprID := fmt.Sprintf("expr-%d", o.ExpressionCounter)
+	tasks, root := o.emitTasks(tree, exprID)
+	span.SetAttributes(attribute.String("expression.id", exprID), attribute.Int("expression.tasks", len(tasks)))
+
 	expression := &types.Expression{
-		ID:     exprID,
-		Status: StatusPending,
-		Tasks:  o.parseExpression(rpn, exprID),
+		ID:          exprID,
+		Seq:         o.ExpressionCounter,
+		FormulaID:   formulaID,
+		Status:      StatusPending,
+		Tasks:       tasks,
+		TasksFolded: folded,
+		Priority:    opts.Priority,
+		Deadline:    opts.Deadline,
+		CreatedAt:   time.Now(),
+		CallbackURL: opts.CallbackURL,
+		TraceParent: tracing.Inject(ctx),
 	}
 
+	// An expression that folds down to a literal, e.g. "-(3)" or "1+1" with
+	// local evaluation enabled, needs no agents.
+	var result *float64
+	if len(tasks) == 0 {
+		value, err := strconv.ParseFloat(root, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression result %q: %w", root, err)
+		}
+		result = &value
+	}
+
+	o.Expressions[exprID] = expression
+	o.indexExpression(expression)
+	if result != nil {
+		expression.Status = StatusDone
+		expression.Result = result
+		o.finishExpression(expression)
+	}
+	o.trackDeadline(expression)
 	for _, task := range expression.Tasks {
 		o.Tasks[task.ID] = task
-		if len(task.Dependencies) == 0 {
-			task.Status = StatusReady
-			go func(t *types.Task) {
-				o.ReadyTasks <- t
-			}(task)
+	}
+
+	changes := &store.Records{}
+	for _, task := range expression.Tasks {
+		if len(task.Dependencies) == 0 && task.Status == StatusPending {
+			o.scheduleReady(task, changes)
 		}
 	}
 
-	o.Expressions[exprID] = expression
-	return exprID, nil
+	o.persist([]*types.Expression{expression}, expression.Tasks)
+	o.metrics.expressionsSubmitted.Inc()
+	return expression, nil
 }
 
-func (o *Orchestrator) parseExpression(tokens []types.Token, exprID string) []*types.Task {
-	var stack []string
-	var tasks []*types.Task
+// GetNextTask leases the next task to the agent. agentID is empty for
+// anonymous agents; unknown agents get errs.ErrAgentNotFound and must
+// register again.
+func (o *Orchestrator) GetNextTask(agentID string) (*types.Task, error) {
+	o.Mu.Lock()
+	defer o.Mu.Unlock()
 
-	for _, token := range tokens {
-		switch token.Type {
-		case TokenNumber:
-			stack = append(stack, token.Value)
-		case TokenOperator:
-			if len(stack) < 2 {
-				continue
-			}
-			arg2 := stack[len(stack)-1]
-			arg1 := stack[len(stack)-2]
-			stack = stack[:len(stack)-2]
+	return o.nextTask(agentID)
+}
+
+// WaitNextTask is GetNextTask that, when no task is ready, waits up to wait
+// for one to be queued. It gives up early when ctx is done.
+func (o *Orchestrator) WaitNextTask(ctx context.Context, agentID string, wait time.Duration) (*types.Task, error) {
+	tasks, err := o.WaitNextTasks(ctx, agentID, 1, wait)
+	if err != nil {
+		return nil, err
+	}
+	return tasks[0], nil
+}
 
-			o.TaskCounter++
-			taskID := fmt.Sprintf("task-%d", o.TaskCounter)
+// WaitNextTasks leases up to limit ready tasks to the agent in one go,
+// waiting up to wait for at least one to be queued.
+func (o *Orchestrator) WaitNextTasks(ctx context.Context, agentID string, limit int, wait time.Duration) ([]*types.Task, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
 
-			deps := make([]string, 0)
-			if !utils.IsNumber(arg1) {
-				deps = append(deps, arg1)
-			}
-			if !utils.IsNumber(arg2) {
-				deps = append(deps, arg2)
-			}
+	for {
+		o.Mu.Lock()
+		tasks, err := o.nextTasks(agentID, limit)
+		taskReady := o.taskReady
+		o.Mu.Unlock()
 
-			task := &types.Task{
-				ID:           taskID,
-				ExpressionID: exprID,
-				Arg1:         arg1,
-				Arg2:         arg2,
-				Operation:    token.Value,
-				Dependencies: deps,
-				Status:       StatusPending,
-			}
+		if !errors.Is(err, errs.ErrNoTasksAvailable) {
+			return tasks, err
+		}
 
-			tasks = append(tasks, task)
-			stack = append(stack, taskID)
+		select {
+		case <-taskReady:
+			// Other agents may take the task first, then wait again.
+		case <-timer.C:
+			return nil, errs.ErrNoTasksAvailable
+		case <-ctx.Done():
+			return nil, errs.ErrNoTasksAvailable
 		}
 	}
-	taskJSON, err := json.MarshalIndent(tasks, "", "  ")
+}
+
+// nextTask leases the next ready task. The caller must hold o.Mu.
+func (o *Orchestrator) nextTask(agentID string) (*types.Task, error) {
+	tasks, err := o.nextTasks(agentID, 1)
 	if err != nil {
-		fmt.Println("Error marshalling task to JSON:", err)
+		return nil, err
 	}
-	fmt.Println(string(taskJSON))
-	return tasks
+	return tasks[0], nil
 }
 
-func (o *Orchestrator) GetNextTask() (*types.Task, error) {
-	o.Mu.Lock()
-	defer o.Mu.Unlock()
+// nextTasks leases up to limit ready tasks and saves them in one batch. It
+// returns errs.ErrNoTasksAvailable when there is none. The caller must hold
+// o.Mu.
+func (o *Orchestrator) nextTasks(agentID string, limit int) ([]*types.Task, error) {
+	if err := o.touchAgent(agentID, time.Now()); err != nil {
+		return nil, err
+	}
 
-	select {
-	case task := <-o.ReadyTasks:
-		if task.Status == StatusReady {
-			task.Status = StatusProgress
-			o.ProcessingTasks[task.ID] = true
-			return task, nil
+	changes := &store.Records{}
+	for len(changes.Tasks) < limit {
+		task := o.leaseNext(agentID, changes)
+		if task == nil {
+			break
 		}
-	default:
+	}
+
+	if len(changes.Tasks) == 0 {
 		return nil, errs.ErrNoTasksAvailable
 	}
-	return nil, errs.ErrNoTasksAvailable
+	o.persistRecords(*changes)
+	return changes.Tasks, nil
 }
 
-func (o *Orchestrator) ProcessTaskResult(taskID string, result float64) error {
+// leaseNext pops the next ready task and leases it to the agent, or returns
+// nil when the queue is empty.
+func (o *Orchestrator) leaseNext(agentID string, changes *store.Records) *types.Task {
+	for {
+		task := o.Scheduler.Pop()
+		if task == nil {
+			return nil
+		}
+		// Tasks cancelled while queued are dropped here.
+		if task.Status != StatusReady {
+			continue
+		}
+
+		now := time.Now()
+		o.LeaseCounter++
+		task.Status = StatusProgress
+		task.LeaseID = fmt.Sprintf("lease-%d", o.LeaseCounter)
+		task.LeaseDeadline = now.Add(o.leaseDuration(task))
+		task.DispatchedAt = &now
+		task.Attempts++
+		task.AgentID = agentID
+		o.ProcessingTasks[task.ID] = true
+
+		if expr, exists := o.Expressions[task.ExpressionID]; exists {
+			o.startTaskSpan(task, expr)
+			if expr.FirstDispatchedAt == nil {
+				expr.FirstDispatchedAt = &now
+			}
+			if task.Attempts == 1 {
+				expr.TasksDispatched++
+				changes.Expressions = append(changes.Expressions, expr)
+			}
+		}
+		changes.Tasks = append(changes.Tasks, task)
+		return task
+	}
+}
+
+func (o *Orchestrator) ProcessTaskResult(taskID, leaseID string, result float64) error {
 	o.Mu.Lock()
 	defer o.Mu.Unlock()
 
-	task, exists := o.Tasks[taskID]
-	if !exists || task.Status != StatusProgress {
-		return errors.New("invalid task")
+	changes := &store.Records{}
+	if err := o.processResult(taskID, leaseID, result, changes); err != nil {
+		return err
+	}
+	o.persistRecords(*changes)
+	return nil
+}
+
+// TaskOutcome is what an agent reports for one task: either Result or Error
+// is set.
+type TaskOutcome struct {
+	TaskID  string
+	LeaseID string
+	Result  *float64
+	Error   *types.ErrorDetail
+}
+
+// ProcessTaskOutcomes applies a batch of results and failures and saves them
+// together. The returned slice holds the error of each outcome, nil for the
+// accepted ones.
+func (o *Orchestrator) ProcessTaskOutcomes(outcomes []TaskOutcome) []error {
+	o.Mu.Lock()
+	defer o.Mu.Unlock()
+
+	changes := &store.Records{}
+	results := make([]error, len(outcomes))
+	for i, outcome := range outcomes {
+		if outcome.Error != nil {
+			results[i] = o.processFailure(outcome.TaskID, outcome.LeaseID, outcome.Error, changes)
+		} else if outcome.Result != nil {
+			results[i] = o.processResult(outcome.TaskID, outcome.LeaseID, *outcome.Result, changes)
+		} else {
+			results[i] = errs.ErrInvalidTaskResult
+			o.metrics.taskResults.WithLabelValues(resultRejected).Inc()
+		}
+	}
+	o.persistRecords(*changes)
+	return results
+}
+
+func (o *Orchestrator) processResult(taskID, leaseID string, result float64, changes *store.Records) error {
+	task, err := o.leasedTask(taskID, leaseID)
+	if err != nil {
+		o.metrics.taskResults.WithLabelValues(resultRejected).Inc()
+		return err
 	}
+	o.observeOutcome(task, resultDone)
+	o.recordComputeTime(task)
+	o.endTaskSpan(task, "")
+	o.completeTask(task, result, changes)
+	return nil
+}
 
+// completeTask stores the result of the task, releases the tasks waiting for
+// it and finishes the expression once its root task is done. Every modified
+// object is added to changes.
+func (o *Orchestrator) completeTask(task *types.Task, result float64, changes *store.Records) {
+	now := time.Now()
 	task.Status = StatusDone
 	task.Result = &result
-	delete(o.ProcessingTasks, taskID)
+	task.ResultAt = &now
+	task.LeaseID = ""
+	delete(o.ProcessingTasks, task.ID)
+	changes.Tasks = append(changes.Tasks, task)
 
-	for _, t := range o.Tasks {
-		if utils.Contains(t.Dependencies, taskID) {
-			t.Dependencies = utils.Remove(t.Dependencies, taskID)
+	expr, exists := o.Expressions[task.ExpressionID]
+	if !exists {
+		return
+	}
+	expr.TasksDone++
+	o.publish(expr, EventProgress)
+
+	for _, t := range expr.Tasks {
+		if utils.Contains(t.Dependencies, task.ID) {
+			t.Dependencies = utils.Remove(t.Dependencies, task.ID)
 			if len(t.Dependencies) == 0 && t.Status == StatusPending {
-				t.Status = StatusReady
-				o.ReadyTasks <- t
+				o.scheduleReady(t, changes)
 			}
+			changes.Tasks = append(changes.Tasks, t)
 		}
 	}
 
-	if expr, exists := o.Expressions[task.ExpressionID]; exists {
-		allDone := true
-		for _, t := range expr.Tasks {
-			if t.Status != StatusDone {
-				allDone = false
-				break
+	if root := expr.Tasks[len(expr.Tasks)-1]; root == task {
+		expr.Status = StatusDone
+		expr.Result = task.Result
+		changes.Expressions = append(changes.Expressions, expr)
+		o.finishExpression(expr)
+	}
+}
+
+// scheduleReady hands a task whose dependencies are resolved to the agents,
+// or evaluates it on the spot when its operation is cheap enough.
+func (o *Orchestrator) scheduleReady(task *types.Task, changes *store.Records) {
+	if o.runsLocally(task.Operation) {
+		if result, err := calc.Apply(task.Operation, o.resolveArgs(task)); err == nil {
+			now := time.Now()
+			task.ReadyAt = &now
+			if expr, exists := o.Expressions[task.ExpressionID]; exists {
+				expr.TasksFolded++
+				changes.Expressions = append(changes.Expressions, expr)
 			}
-		}
-		if allDone {
-			expr.Status = StatusDone
-			expr.Result = task.Result
+			o.completeTask(task, result, changes)
+			return
 		}
 	}
+	o.enqueueReady(task)
+}
 
+// ProcessTaskFailure records that an agent could not compute the task. The task
+// and its expression move to the error state and every other unfinished task of
+// the expression is cancelled.
+func (o *Orchestrator) ProcessTaskFailure(taskID, leaseID, code, message string) error {
+	o.Mu.Lock()
+	defer o.Mu.Unlock()
+
+	changes := &store.Records{}
+	if err := o.processFailure(taskID, leaseID, &types.ErrorDetail{Code: code, Message: message}, changes); err != nil {
+		return err
+	}
+	o.persistRecords(*changes)
 	return nil
 }
 
+func (o *Orchestrator) processFailure(taskID, leaseID string, detail *types.ErrorDetail, changes *store.Records) error {
+	task, err := o.leasedTask(taskID, leaseID)
+	if err != nil {
+		o.metrics.taskResults.WithLabelValues(resultRejected).Inc()
+		return err
+	}
+	o.observeOutcome(task, resultFailed)
+	o.recordComputeTime(task)
+	o.endTaskSpan(task, detail.Code+": "+detail.Message)
+
+	now := time.Now()
+	task.Status = StatusError
+	task.Error = detail
+	task.ResultAt = &now
+	task.LeaseID = ""
+	delete(o.ProcessingTasks, taskID)
+
+	if expr, exists := o.Expressions[task.ExpressionID]; exists {
+		o.failExpression(expr, detail)
+		changes.Expressions = append(changes.Expressions, expr)
+		changes.Tasks = append(changes.Tasks, expr.Tasks...)
+	} else {
+		changes.Tasks = append(changes.Tasks, task)
+	}
+
+	logger.Warnf("Task %s failed with %s: %s", taskID, detail.Code, detail.Message)
+	return nil
+}
+
+func (o *Orchestrator) leasedTask(taskID, leaseID string) (*types.Task, error) {
+	task, exists := o.Tasks[taskID]
+	if !exists {
+		return nil, errs.ErrTaskNotFound
+	}
+	if task.Status == StatusCancelled {
+		return nil, errs.ErrTaskCancelled
+	}
+	if task.Status != StatusProgress || task.LeaseID != leaseID {
+		return nil, errs.ErrLeaseExpired
+	}
+	return task, nil
+}
+
+// recordComputeTime adds the time the task waited in the queue and spent on
+// its agent to the totals of its expression. It is called when the outcome
+// of the task arrives. The caller must hold o.Mu.
+func (o *Orchestrator) recordComputeTime(task *types.Task) {
+	expr, exists := o.Expressions[task.ExpressionID]
+	if !exists || task.DispatchedAt == nil {
+		return
+	}
+	now := time.Now()
+	expr.ComputeTime += now.Sub(*task.DispatchedAt)
+	if task.ReadyAt != nil {
+		expr.QueueTime += task.DispatchedAt.Sub(*task.ReadyAt)
+	}
+}
+
+// finishExpression records that the expression reached a final status,
+// announces it and queues its webhook. The caller must hold o.Mu and persist
+// the expression.
+func (o *Orchestrator) finishExpression(expr *types.Expression) {
+	now := time.Now()
+	expr.CompletedAt = &now
+	o.reindexStatus(expr, StatusPending)
+	o.publish(expr, EventStatus)
+	o.queueWebhook(expr)
+}
+
+func (o *Orchestrator) failExpression(expr *types.Expression, detail *types.ErrorDetail) {
+	expr.Status = StatusError
+	expr.Error = detail
+	o.cancelTasks(expr)
+	o.finishExpression(expr)
+}
+
+// CancelExpression stops an expression that is still running. Its queued
+// tasks are dropped, results for its tasks are rejected, and agents working
+// on them are told to stop on their next poll. It returns the cancelled
+// expression.
+func (o *Orchestrator) CancelExpression(id string) (types.ExpressionResponse, error) {
+	o.Mu.Lock()
+	defer o.Mu.Unlock()
+
+	expr, exists := o.Expressions[id]
+	if !exists {
+		return types.ExpressionResponse{}, errs.ErrExpressionNotFound
+	}
+	if expr.Status != StatusPending {
+		return types.ExpressionResponse{}, errs.ErrExpressionFinished
+	}
+
+	expr.Status = StatusCancelled
+	o.cancelTasks(expr)
+	o.finishExpression(expr)
+	o.persist([]*types.Expression{expr}, expr.Tasks)
+
+	logger.Infof("Expression %s cancelled", id)
+	return expressionResponse(expr), nil
+}
+
+// cancelTasks cancels every unfinished task of the expression.
+func (o *Orchestrator) cancelTasks(expr *types.Expression) {
+	o.Scheduler.RemoveExpression(expr.ID)
+
+	for _, t := range expr.Tasks {
+		switch t.Status {
+		case StatusProgress:
+			o.CancelledTasks[t.ID] = t.LeaseDeadline
+			o.endTaskSpan(t, "cancelled")
+			fallthrough
+		case StatusPending, StatusReady:
+			t.Status = StatusCancelled
+			t.LeaseID = ""
+			delete(o.ProcessingTasks, t.ID)
+		}
+	}
+}
+
+// CancelledTaskIDs returns the tasks the agent should stop working on. An
+// empty ID stands for the anonymous agents, which share their tasks.
+func (o *Orchestrator) CancelledTaskIDs(agentID string, now time.Time) []string {
+	o.Mu.RLock()
+	defer o.Mu.RUnlock()
+
+	return o.cancelledTaskIDs(agentID, now)
+}
+
+// cancelledTaskIDs is CancelledTaskIDs for callers that hold o.Mu.
+func (o *Orchestrator) cancelledTaskIDs(agentID string, now time.Time) []string {
+	ids := make([]string, 0)
+	for id, deadline := range o.CancelledTasks {
+		if now.After(deadline) {
+			continue
+		}
+		if task, exists := o.Tasks[id]; exists && task.AgentID == agentID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ForgetCancelledTasks drops the cancelled tasks whose lease has run out:
+// their agents are considered gone. It returns how many were dropped.
+func (o *Orchestrator) ForgetCancelledTasks(now time.Time) int {
+	o.Mu.Lock()
+	defer o.Mu.Unlock()
+
+	forgotten := 0
+	for id, deadline := range o.CancelledTasks {
+		if now.After(deadline) {
+			delete(o.CancelledTasks, id)
+			forgotten++
+		}
+	}
+	return forgotten
+}
+
+func (o *Orchestrator) leaseDuration(task *types.Task) time.Duration {
+	return o.OperationTimes[task.Operation]*time.Millisecond + leaseGracePeriod
+}
+
+func (o *Orchestrator) runLeaseReaper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if n := o.ReapExpiredLeases(now); n > 0 {
+			logger.Warnf("Re-queued %d tasks with expired leases", n)
+		}
+		if n := o.EvictAgents(now); n > 0 {
+			logger.Warnf("Evicted %d agents that missed their heartbeats", n)
+		}
+		if n := o.ExpireDeadlines(now); n > 0 {
+			logger.Warnf("Failed %d expressions that missed their deadline", n)
+		}
+		o.ForgetCancelledTasks(now)
+	}
+}
+
+// ReapExpiredLeases puts every in-progress task whose lease deadline has
+// passed back on the ready queue and returns how many tasks were re-queued.
+// Results submitted later under the old lease are rejected.
+func (o *Orchestrator) ReapExpiredLeases(now time.Time) int {
+	o.Mu.Lock()
+	defer o.Mu.Unlock()
+
+	requeued := 0
+	for taskID := range o.ProcessingTasks {
+		task, exists := o.Tasks[taskID]
+		if !exists || task.Status != StatusProgress {
+			delete(o.ProcessingTasks, taskID)
+			continue
+		}
+		if now.Before(task.LeaseDeadline) {
+			continue
+		}
+
+		logger.Debugf("Lease %s for task %s expired, re-queueing", task.LeaseID, task.ID)
+		o.endTaskSpan(task, "lease expired")
+		task.LeaseID = ""
+		task.LeaseDeadline = time.Time{}
+		delete(o.ProcessingTasks, taskID)
+		o.enqueueReady(task)
+		requeued++
+	}
+	return requeued
+}
+
 func tokenize(expression string) ([]types.Token, error) {
 	var tokens []types.Token
 	var i int
@@ -214,6 +945,38 @@ func tokenize(expression string) ([]types.Token, error) {
 			continue
 		}
 
+		if ch == ',' {
+			tokens = append(tokens, types.Token{Type: TokenComma, Value: string(ch)})
+			prevToken = tokens[len(tokens)-1]
+			i++
+			continue
+		}
+
+		if unicode.IsLetter(rune(ch)) || ch == '_' {
+			start := i
+			for i < len(expression) && isIdentifierChar(expression[i]) {
+				i++
+			}
+			name := expression[start:i]
+
+			next := i
+			for next < len(expression) && unicode.IsSpace(rune(expression[next])) {
+				next++
+			}
+			if next == len(expression) || expression[next] != '(' {
+				tokens = append(tokens, types.Token{Type: TokenIdentifier, Value: name, Pos: start})
+				prevToken = tokens[len(tokens)-1]
+				continue
+			}
+			if _, known := functions[name]; !known {
+				return nil, fmt.Errorf("unknown function '%s' at position %d", name, start)
+			}
+
+			tokens = append(tokens, types.Token{Type: TokenFunction, Value: name, Pos: start})
+			prevToken = tokens[len(tokens)-1]
+			continue
+		}
+
 		if ch == '(' {
 			tokens = append(tokens, types.Token{Type: TokenLeftParen, Value: string(ch)})
 			prevToken = tokens[len(tokens)-1]
@@ -228,10 +991,15 @@ func tokenize(expression string) ([]types.Token, error) {
 			continue
 		}
 
-		if ch == '+' || ch == '-' || ch == '*' || ch == '/' {
+		if strings.IndexByte(operatorChars, ch) >= 0 {
+			op := string(ch)
+			if ch == '/' && i+1 < len(expression) && expression[i+1] == '/' {
+				op = "//"
+			}
+
 			isUnary := false
 			if ch == '+' || ch == '-' {
-				if len(tokens) == 0 || prevToken.Type == TokenOperator || prevToken.Type == TokenLeftParen {
+				if len(tokens) == 0 || prevToken.Type == TokenOperator || prevToken.Type == TokenLeftParen || prevToken.Type == TokenComma {
 					isUnary = true
 				}
 			}
@@ -241,12 +1009,12 @@ func tokenize(expression string) ([]types.Token, error) {
 			}
 
 			if !isUnary && prevToken.Type == TokenOperator && !prevToken.IsUnary {
-				return nil, fmt.Errorf("two operators '%s' and '%s' cannot be next to each other at position %d", prevToken.Value, string(ch), i)
+				return nil, fmt.Errorf("two operators '%s' and '%s' cannot be next to each other at position %d", prevToken.Value, op, i)
 			}
 
-			tokens = append(tokens, types.Token{Type: TokenOperator, Value: string(ch), IsUnary: isUnary})
+			tokens = append(tokens, types.Token{Type: TokenOperator, Value: op, IsUnary: isUnary})
 			prevToken = tokens[len(tokens)-1]
-			i++
+			i += len(op)
 			continue
 		}
 
@@ -263,7 +1031,7 @@ func tokenize(expression string) ([]types.Token, error) {
 				i++
 			}
 			numberStr := expression[start:i]
-			tokens = append(tokens, types.Token{Type: TokenNumber, Value: numberStr})
+			tokens = append(tokens, types.Token{Type: TokenNumber, Value: numberStr, Pos: start})
 			prevToken = tokens[len(tokens)-1]
 			continue
 		}
@@ -292,19 +1060,25 @@ func ValidateExpression(expression string) error {
 			}
 		}
 
-		if !unicode.IsDigit(rune(ch)) && ch != '.' && ch != '+' && ch != '-' &&
-			ch != '*' && ch != '/' && ch != '(' && ch != ')' && !unicode.IsSpace(rune(ch)) {
+		isOperator := strings.IndexByte(operatorChars, ch) >= 0
+
+		if !isIdentifierChar(ch) && ch != '.' && ch != ',' && !isOperator &&
+			ch != '(' && ch != ')' && !unicode.IsSpace(rune(ch)) {
 			return fmt.Errorf("invalid character '%c' at position %d", ch, i)
 		}
 
-		if i == len(expression)-1 && (ch == '+' || ch == '-' || ch == '*' || ch == '/') {
+		if i == len(expression)-1 && isOperator {
 			return fmt.Errorf("expression cannot end with operator '%c'", ch)
 		}
 
-		if i > 0 && (ch == '*' || ch == '/') &&
-			(expression[i-1] == '+' || expression[i-1] == '-' ||
-				expression[i-1] == '*' || expression[i-1] == '/') {
-			return fmt.Errorf("two operators '%c' and '%c' cannot be adjacent at position %d", expression[i-1], ch, i)
+		// Only '+' and '-' may follow another operator (as a sign). The
+		// exception is the second slash of the "//" operator.
+		if i > 0 && isOperator && ch != '+' && ch != '-' &&
+			strings.IndexByte(operatorChars, expression[i-1]) >= 0 {
+			isFloorDivision := ch == '/' && expression[i-1] == '/' && (i < 2 || expression[i-2] != '/')
+			if !isFloorDivision {
+				return fmt.Errorf("two operators '%c' and '%c' cannot be adjacent at position %d", expression[i-1], ch, i)
+			}
 		}
 	}
 
@@ -315,88 +1089,143 @@ func ValidateExpression(expression string) error {
 	return nil
 }
 
-func (o *Orchestrator) GetAllExpressions() ([]*types.Expression, error) {
-	o.Mu.RLock()
-	defer o.Mu.RUnlock()
-
-	if o.Expressions == nil {
-		return nil, fmt.Errorf("expressions map is nil")
-	}
-
-	expressions := make([]*types.Expression, 0, len(o.Expressions))
-	for _, expr := range o.Expressions {
-		if expr == nil {
-			return nil, fmt.Errorf("nil expression found in map")
-		}
-		expressions = append(expressions, expr)
-	}
-	return expressions, nil
-}
-
-func (o *Orchestrator) GetExpression(id string) (*types.Expression, bool, error) {
+func (o *Orchestrator) GetExpression(id string) (types.ExpressionResponse, bool, error) {
 	o.Mu.RLock()
 	defer o.Mu.RUnlock()
 
 	if o.Expressions == nil {
-		return nil, false, fmt.Errorf("expressions map is nil")
+		return types.ExpressionResponse{}, false, fmt.Errorf("expressions map is nil")
 	}
 
 	expr, exists := o.Expressions[id]
 	if !exists {
-		return nil, false, nil
+		return types.ExpressionResponse{}, false, nil
 	}
 
 	if expr == nil {
-		return nil, true, fmt.Errorf("nil expression found in map for id %s", id)
+		return types.ExpressionResponse{}, true, fmt.Errorf("nil expression found in map for id %s", id)
 	}
 
-	return expr, true, nil
+	return expressionResponse(expr), true, nil
 }
 
-func (o *Orchestrator) ResolveTaskDependencies(task *types.Task) map[string]interface{} {
-	result := make(map[string]interface{})
+// expressionResponse is the API representation of the expression. The
+// caller must hold o.Mu: agents keep updating the expression until it
+// finishes.
+func expressionResponse(expr *types.Expression) types.ExpressionResponse {
+	return types.ExpressionResponse{
+		ID:        expr.ID,
+		FormulaID: expr.FormulaID,
+		Status:    expr.Status,
+		Result:    expr.Result,
+		Error:     expr.Error,
+
+		TasksFolded:     expr.TasksFolded,
+		TasksDispatched: expr.TasksDispatched,
+		Priority:        expr.Priority,
+		Deadline:        expr.Deadline,
+		CallbackURL:     expr.CallbackURL,
+
+		CreatedAt:         expr.CreatedAt,
+		FirstDispatchedAt: expr.FirstDispatchedAt,
+		CompletedAt:       expr.CompletedAt,
+		QueueTimeMs:       expr.QueueTime.Milliseconds(),
+		ComputeTimeMs:     expr.ComputeTime.Milliseconds(),
+	}
+}
+
+// TaskResponse is the API representation of a leased task, with its
+// arguments resolved by resolveArgs.
+func (o *Orchestrator) TaskResponse(task *types.Task) types.TaskResponse {
 	o.Mu.RLock()
 	defer o.Mu.RUnlock()
 
-	resolveArg := func(arg string) float64 {
-		if utils.IsNumber(arg) {
-			val, _ := strconv.ParseFloat(arg, 64)
-			return val
-		}
-		if t, exists := o.Tasks[arg]; exists && t.Result != nil {
-			return *t.Result
-		}
-		return math.NaN()
+	return types.TaskResponse{
+		ID:            task.ID,
+		LeaseID:       task.LeaseID,
+		Operation:     task.Operation,
+		Args:          o.resolveArgs(task),
+		OperationTime: int(o.OperationTimes[task.Operation]),
+		TraceParent:   task.TraceParent,
 	}
+}
 
-	arg1 := resolveArg(task.Arg1)
-	arg2 := resolveArg(task.Arg2)
+func (o *Orchestrator) ResolveTaskDependencies(task *types.Task) map[string]interface{} {
+	result := make(map[string]interface{})
+	o.Mu.RLock()
+	defer o.Mu.RUnlock()
 
 	result["id"] = task.ID
 	result["operation"] = task.Operation
-	result["arg1"] = arg1
-	result["arg2"] = arg2
+	result["args"] = o.resolveArgs(task)
 	result["operation_time"] = o.OperationTimes[task.Operation]
 
 	return result
 }
 
+// resolveArgs returns the numeric arguments of the task, taking results of
+// finished dependencies. Unresolved arguments are NaN. The caller must hold
+// o.Mu.
+func (o *Orchestrator) resolveArgs(task *types.Task) []float64 {
+	args := make([]float64, 0, len(task.Args))
+	for _, arg := range task.Args {
+		if utils.IsNumber(arg) {
+			val, _ := strconv.ParseFloat(arg, 64)
+			args = append(args, val)
+		} else if t, exists := o.Tasks[arg]; exists && t.Result != nil {
+			args = append(args, *t.Result)
+		} else {
+			args = append(args, math.NaN())
+		}
+	}
+	return args
+}
+
 func toRPN(tokens []types.Token) ([]types.Token, error) {
 	var outputQueue []types.Token
 	var operatorStack []types.Token
+	// argCounts holds the number of arguments seen so far for every open
+	// function call, innermost last.
+	var argCounts []int
+
+	// popUntilLeftParen moves operators to the output until a left paren is on
+	// top of the stack, leaving the paren in place.
+	popUntilLeftParen := func() bool {
+		for len(operatorStack) > 0 {
+			top := operatorStack[len(operatorStack)-1]
+			if top.Type == TokenLeftParen {
+				return true
+			}
+			outputQueue = append(outputQueue, top)
+			operatorStack = operatorStack[:len(operatorStack)-1]
+		}
+		return false
+	}
 
-	for _, token := range tokens {
+	for i, token := range tokens {
 		switch token.Type {
-		case TokenNumber:
+		case TokenNumber, TokenIdentifier:
 			outputQueue = append(outputQueue, token)
+		case TokenFunction:
+			operatorStack = append(operatorStack, token)
+		case TokenComma:
+			if !popUntilLeftParen() || len(operatorStack) < 2 || operatorStack[len(operatorStack)-2].Type != TokenFunction {
+				return nil, fmt.Errorf("unexpected ',' outside of a function call")
+			}
+			argCounts[len(argCounts)-1]++
 		case TokenOperator:
 			if token.IsUnary {
 				operatorStack = append(operatorStack, token)
 				continue
 			}
+			precedence := operatorPrecedence(token.Value)
 			for len(operatorStack) > 0 {
 				top := operatorStack[len(operatorStack)-1]
-				if top.Type == TokenOperator && operatorPrecedence(top.Value) >= operatorPrecedence(token.Value) {
+				if top.Type != TokenOperator {
+					break
+				}
+				topPrecedence := tokenPrecedence(top)
+				if topPrecedence > precedence || (topPrecedence == precedence && !isRightAssociative(token.Value)) {
 					outputQueue = append(outputQueue, top)
 					operatorStack = operatorStack[:len(operatorStack)-1]
 				} else {
@@ -405,21 +1234,29 @@ func toRPN(tokens []types.Token) ([]types.Token, error) {
 			}
 			operatorStack = append(operatorStack, token)
 		case TokenLeftParen:
+			if len(operatorStack) > 0 && operatorStack[len(operatorStack)-1].Type == TokenFunction {
+				argCounts = append(argCounts, 1)
+			}
 			operatorStack = append(operatorStack, token)
 		case TokenRightParen:
-			foundLeftParen := false
-			for len(operatorStack) > 0 {
-				top := operatorStack[len(operatorStack)-1]
+			if !popUntilLeftParen() {
+				return nil, fmt.Errorf("mismatched parentheses")
+			}
+			operatorStack = operatorStack[:len(operatorStack)-1]
+
+			if len(operatorStack) > 0 && operatorStack[len(operatorStack)-1].Type == TokenFunction {
+				function := operatorStack[len(operatorStack)-1]
 				operatorStack = operatorStack[:len(operatorStack)-1]
-				if top.Type == TokenLeftParen {
-					foundLeftParen = true
-					break
-				} else {
-					outputQueue = append(outputQueue, top)
+
+				function.ArgCount = argCounts[len(argCounts)-1]
+				argCounts = argCounts[:len(argCounts)-1]
+				if tokens[i-1].Type == TokenLeftParen {
+					function.ArgCount = 0
 				}
-			}
-			if !foundLeftParen {
-				return nil, fmt.Errorf("mismatched parentheses")
+				if err := checkArity(function); err != nil {
+					return nil, err
+				}
+				outputQueue = append(outputQueue, function)
 			}
 		}
 	}
@@ -436,13 +1273,40 @@ func toRPN(tokens []types.Token) ([]types.Token, error) {
 	return outputQueue, nil
 }
 
+// tokenPrecedence ranks unary signs above the multiplicative operators, so
+// "2*-3" binds the sign to its operand first, but below "^", so "-2^2" is -4.
+func tokenPrecedence(token types.Token) int {
+	if token.IsUnary {
+		return 3
+	}
+	return operatorPrecedence(token.Value)
+}
+
 func operatorPrecedence(op string) int {
 	switch op {
 	case "+", "-":
 		return 1
-	case "*", "/":
+	case "*", "/", "%", "//":
 		return 2
+	case "^":
+		return 4
 	default:
 		return 0
 	}
 }
+
+func checkArity(function types.Token) error {
+	spec := functions[function.Value]
+	if function.ArgCount < spec.minArgs || (spec.maxArgs != variadic && function.ArgCount > spec.maxArgs) {
+		return fmt.Errorf("function '%s' does not accept %d arguments", function.Value, function.ArgCount)
+	}
+	return nil
+}
+
+func isIdentifierChar(ch byte) bool {
+	return unicode.IsLetter(rune(ch)) || unicode.IsDigit(rune(ch)) || ch == '_'
+}
+
+func isRightAssociative(op string) bool {
+	return op == "^"
+}
@@ -0,0 +1,324 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+
+	"distr-comp/internal/calc"
+	errs "distr-comp/internal/orchestrator/errors"
+	store "distr-comp/internal/orchestrator/store"
+	types "distr-comp/internal/orchestrator/types"
+)
+
+// referenceEval evaluates the expression directly with a recursive-descent
+// parser, using the usual rules: "^" is right-associative and binds tighter
+// than a unary sign on its left, and a sign may start any operand.
+func referenceEval(t *testing.T, expr string) float64 {
+	t.Helper()
+	p := &referenceParser{src: strings.ReplaceAll(expr, " ", "")}
+	value := p.expr()
+	if p.pos != len(p.src) {
+		t.Fatalf("reference evaluator stopped at %d in %q", p.pos, expr)
+	}
+	return value
+}
+
+type referenceParser struct {
+	src string
+	pos int
+}
+
+func (p *referenceParser) peek() byte {
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *referenceParser) expr() float64 {
+	value := p.term()
+	for {
+		switch p.peek() {
+		case '+':
+			p.pos++
+			value += p.term()
+		case '-':
+			p.pos++
+			value -= p.term()
+		default:
+			return value
+		}
+	}
+}
+
+func (p *referenceParser) term() float64 {
+	value := p.unary()
+	for {
+		switch {
+		case strings.HasPrefix(p.src[p.pos:], "//"):
+			p.pos += 2
+			value = math.Floor(value / p.unary())
+		case p.peek() == '*':
+			p.pos++
+			value *= p.unary()
+		case p.peek() == '/':
+			p.pos++
+			value /= p.unary()
+		case p.peek() == '%':
+			p.pos++
+			value = math.Mod(value, p.unary())
+		default:
+			return value
+		}
+	}
+}
+
+func (p *referenceParser) unary() float64 {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		return -p.unary()
+	case '+':
+		p.pos++
+		return p.unary()
+	}
+	return p.power()
+}
+
+func (p *referenceParser) power() float64 {
+	base := p.primary()
+	if p.peek() == '^' {
+		p.pos++
+		return math.Pow(base, p.unary())
+	}
+	return base
+}
+
+func (p *referenceParser) primary() float64 {
+	if p.peek() == '(' {
+		p.pos++
+		value := p.expr()
+		p.pos++
+		return value
+	}
+
+	start := p.pos
+	if unicode.IsLetter(rune(p.peek())) {
+		for unicode.IsLetter(rune(p.peek())) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		p.pos++
+		args := []float64{p.expr()}
+		for p.peek() == ',' {
+			p.pos++
+			args = append(args, p.expr())
+		}
+		p.pos++
+		switch name {
+		case "sqrt":
+			return math.Sqrt(args[0])
+		case "abs":
+			return math.Abs(args[0])
+		case "min", "max":
+			value := args[0]
+			for _, arg := range args[1:] {
+				if (name == "min") == (arg < value) {
+					value = arg
+				}
+			}
+			return value
+		case "pow":
+			return math.Pow(args[0], args[1])
+		}
+		panic("reference evaluator: unknown function " + name)
+	}
+
+	for unicode.IsDigit(rune(p.peek())) || p.peek() == '.' {
+		p.pos++
+	}
+	value, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+	if err != nil {
+		panic("reference evaluator: " + err.Error())
+	}
+	return value
+}
+
+// runGraph compiles the expression into tasks the way AddExpression does and
+// computes them in emission order with calc.Apply, as agents would.
+func runGraph(t *testing.T, expr string) float64 {
+	t.Helper()
+	o := &Orchestrator{OperationTimes: map[string]time.Duration{
+		"+": 1, "-": 1, "*": 1, "/": 1, "^": 1, "%": 1, "//": 1, OperationNegate: 1,
+		"sqrt": 1, "abs": 1, "min": 1, "max": 1, "pow": 1,
+	}}
+
+	rpn, err := compile(context.Background(), expr)
+	if err != nil {
+		t.Fatalf("compile(%q): %v", expr, err)
+	}
+	tree, err := buildTree(rpn, nil)
+	if err != nil {
+		t.Fatalf("buildTree(%q): %v", expr, err)
+	}
+	o.rebalance(tree)
+	tasks, root := o.emitTasks(tree, "expr-1")
+
+	results := make(map[string]float64)
+	resolve := func(arg string) float64 {
+		if value, done := results[arg]; done {
+			return value
+		}
+		value, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			t.Fatalf("%q: argument %q is neither a number nor a finished task", expr, arg)
+		}
+		return value
+	}
+	for _, task := range tasks {
+		args := make([]float64, 0, len(task.Args))
+		for _, arg := range task.Args {
+			args = append(args, resolve(arg))
+		}
+		result, err := calc.Apply(task.Operation, args)
+		if err != nil {
+			t.Fatalf("%q: task %s %s%v: %v", expr, task.ID, task.Operation, args, err)
+		}
+		results[task.ID] = result
+	}
+	return resolve(root)
+}
+
+func TestGraphMatchesReferenceEvaluator(t *testing.T) {
+	expressions := []string{
+		"-(2+3)",
+		"2*-3",
+		"-2^2",
+		"2^-1",
+		"2^-3^2",
+		"--3",
+		"3 - -2",
+		"2-3*-(1+1)",
+		"-sqrt(4)",
+		"2^3^2",
+		"10-4-3",
+		"7//2*3%4",
+		"-(1+2)*-(3+4)",
+		"max(1, -2^2, abs(-3))",
+		"1+2+3+4+5+6+7+8",
+	}
+	for _, expr := range expressions {
+		t.Run(expr, func(t *testing.T) {
+			want := referenceEval(t, expr)
+			if got := runGraph(t, expr); math.Abs(got-want) > 1e-12*math.Max(1, math.Abs(want)) {
+				t.Errorf("%q = %v, want %v", expr, got, want)
+			}
+		})
+	}
+}
+
+func TestBuildTreeRejectsInvalidNumbers(t *testing.T) {
+	for _, expr := range []string{".", "1+.", "sqrt(.)"} {
+		rpn, err := compile(context.Background(), expr)
+		if err != nil {
+			t.Fatalf("compile(%q): %v", expr, err)
+		}
+		if _, err := buildTree(rpn, nil); !errors.Is(err, errs.ErrInvalidNumber) {
+			t.Errorf("buildTree(%q): got %v, want %v", expr, err, errs.ErrInvalidNumber)
+		}
+	}
+}
+
+func TestNewOrchestratorLeavesConfigAlone(t *testing.T) {
+	if _, err := NewOrchestrator(Config{}, store.NewNopStore()); err != nil {
+		t.Fatalf("NewOrchestrator without operation times: %v", err)
+	}
+
+	operationTimes := map[string]time.Duration{"-": 5}
+	if _, err := NewOrchestrator(Config{OperationTimes: operationTimes}, store.NewNopStore()); err != nil {
+		t.Fatalf("NewOrchestrator: %v", err)
+	}
+	if _, added := operationTimes[OperationNegate]; added || len(operationTimes) != 1 {
+		t.Errorf("NewOrchestrator changed the operation times of the config: %v", operationTimes)
+	}
+}
+
+// leaseTask leases the next task and returns it as the agent sees it.
+func leaseTask(t *testing.T, o *Orchestrator) types.TaskResponse {
+	t.Helper()
+	task, err := o.GetNextTask("")
+	if err != nil {
+		t.Fatalf("GetNextTask: %v", err)
+	}
+	return o.TaskResponse(task)
+}
+
+func TestRestoreFromBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orchestrator.db")
+	cfg := Config{OperationTimes: map[string]time.Duration{"+": 10, "*": 10}}
+
+	st, err := store.NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltStore: %v", err)
+	}
+	o, err := NewOrchestrator(cfg, st)
+	if err != nil {
+		t.Fatalf("NewOrchestrator: %v", err)
+	}
+	exprID, err := o.AddExpression(context.Background(), "(1+2)*(3+4)", ExpressionOptions{})
+	if err != nil {
+		t.Fatalf("AddExpression: %v", err)
+	}
+	done := leaseTask(t, o)
+	if err := o.ProcessTaskResult(done.ID, done.LeaseID, 3); err != nil {
+		t.Fatalf("ProcessTaskResult(%s): %v", done.ID, err)
+	}
+	// The agent holding the second task is lost with the restart.
+	lost := leaseTask(t, o)
+	if err := st.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	st, err = store.NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltStore after restart: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	o, err = NewOrchestrator(cfg, st)
+	if err != nil {
+		t.Fatalf("NewOrchestrator after restart: %v", err)
+	}
+
+	requeued := leaseTask(t, o)
+	if requeued.ID != lost.ID || requeued.LeaseID == lost.LeaseID {
+		t.Fatalf("got task %s with lease %s, want %s re-queued with a new lease", requeued.ID, requeued.LeaseID, lost.ID)
+	}
+	if err := o.ProcessTaskResult(requeued.ID, requeued.LeaseID, 7); err != nil {
+		t.Fatalf("ProcessTaskResult(%s): %v", requeued.ID, err)
+	}
+	root := leaseTask(t, o)
+	if len(root.Args) != 2 || root.Args[0]*root.Args[1] != 21 {
+		t.Fatalf("got root task %s with args %v, want the results 3 and 7", root.ID, root.Args)
+	}
+	if err := o.ProcessTaskResult(root.ID, root.LeaseID, 21); err != nil {
+		t.Fatalf("ProcessTaskResult(%s): %v", root.ID, err)
+	}
+	if expr, _, _ := o.GetExpression(exprID); expr.Status != StatusDone || expr.Result == nil || *expr.Result != 21 {
+		t.Errorf("got status %s, result %v, want done with 21", expr.Status, expr.Result)
+	}
+
+	nextID, err := o.AddExpression(context.Background(), "4*5", ExpressionOptions{})
+	if err != nil {
+		t.Fatalf("AddExpression after restart: %v", err)
+	}
+	if next := leaseTask(t, o); nextID != "expr-2" || next.ID != "task-4" {
+		t.Errorf("got %s with %s after restart, want expr-2 with task-4", nextID, next.ID)
+	}
+}
@@ -0,0 +1,58 @@
+package orchestrator
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+
+	types "distr-comp/internal/orchestrator/types"
+)
+
+// trackDeadline makes ExpireDeadlines watch the expression when it is
+// pending and has a deadline. The caller must hold o.Mu.
+func (o *Orchestrator) trackDeadline(expr *types.Expression) {
+	if expr.Status == StatusPending && expr.Deadline != nil {
+		heap.Push(&o.deadlines, expr)
+	}
+}
+
+// ExpireDeadlines fails every pending expression whose deadline has passed
+// with ErrorCodeDeadlineExceeded and returns how many expressions failed.
+// Only expressions whose deadline has come are looked at; the ones that
+// finished in time are dropped from the heap then.
+func (o *Orchestrator) ExpireDeadlines(now time.Time) int {
+	o.Mu.Lock()
+	defer o.Mu.Unlock()
+
+	expired := 0
+	for o.deadlines.Len() > 0 && !now.Before(*o.deadlines[0].Deadline) {
+		expr := heap.Pop(&o.deadlines).(*types.Expression)
+		if expr.Status != StatusPending {
+			continue
+		}
+
+		o.failExpression(expr, &types.ErrorDetail{
+			Code:    ErrorCodeDeadlineExceeded,
+			Message: fmt.Sprintf("deadline %s passed before the expression finished", expr.Deadline.Format(time.RFC3339Nano)),
+		})
+		o.persist([]*types.Expression{expr}, expr.Tasks)
+		expired++
+	}
+	return expired
+}
+
+// deadlineHeap is a min-heap of expressions by deadline.
+type deadlineHeap []*types.Expression
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].Deadline.Before(*h[j].Deadline) }
+func (h deadlineHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *deadlineHeap) Push(x interface{}) {
+	*h = append(*h, x.(*types.Expression))
+}
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	expr := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return expr
+}
@@ -0,0 +1,126 @@
+package orchestrator
+
+import (
+	"sync"
+
+	errs "distr-comp/internal/orchestrator/errors"
+	types "distr-comp/internal/orchestrator/types"
+)
+
+// Event types published on the EventBus.
+const (
+	EventStatus   = "status"
+	EventProgress = "progress"
+)
+
+// subscriberBuffer is the number of events a subscriber may fall behind.
+// Progress events beyond it are dropped; status events replace the oldest
+// queued event.
+const subscriberBuffer = 64
+
+// EventBus fans expression events out to subscribers. Publishing never
+// blocks, so it is safe to do while holding the orchestrator lock.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan types.ExpressionEvent]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[string]map[chan types.ExpressionEvent]struct{})}
+}
+
+// Subscribe returns a channel receiving the events of the expression. It is
+// closed after the final status event or when unsubscribe is called.
+func (b *EventBus) Subscribe(exprID string) (<-chan types.ExpressionEvent, func()) {
+	ch := make(chan types.ExpressionEvent, subscriberBuffer)
+
+	b.mu.Lock()
+	if b.subscribers[exprID] == nil {
+		b.subscribers[exprID] = make(map[chan types.ExpressionEvent]struct{})
+	}
+	b.subscribers[exprID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.remove(exprID, ch)
+	}
+	return ch, unsubscribe
+}
+
+func (b *EventBus) Publish(event types.ExpressionEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	final := event.Type == EventStatus && event.Status != StatusPending
+	for ch := range b.subscribers[event.ExpressionID] {
+		select {
+		case ch <- event:
+		default:
+			if event.Type == EventStatus {
+				select {
+				case <-ch:
+				default:
+				}
+				select {
+				case ch <- event:
+				default:
+				}
+			}
+		}
+		if final {
+			b.remove(event.ExpressionID, ch)
+		}
+	}
+}
+
+// remove closes and forgets a subscriber. The caller must hold b.mu.
+func (b *EventBus) remove(exprID string, ch chan types.ExpressionEvent) {
+	if _, exists := b.subscribers[exprID][ch]; !exists {
+		return
+	}
+	delete(b.subscribers[exprID], ch)
+	close(ch)
+	if len(b.subscribers[exprID]) == 0 {
+		delete(b.subscribers, exprID)
+	}
+}
+
+// SubscribeExpression returns the current state of the expression as a status
+// event together with a subscription to its later events, so that no
+// transition is missed in between. The subscription is nil when the
+// expression has already finished.
+func (o *Orchestrator) SubscribeExpression(id string) (types.ExpressionEvent, <-chan types.ExpressionEvent, func(), error) {
+	o.Mu.RLock()
+	defer o.Mu.RUnlock()
+
+	expr, exists := o.Expressions[id]
+	if !exists {
+		return types.ExpressionEvent{}, nil, nil, errs.ErrExpressionNotFound
+	}
+
+	snapshot := expressionEvent(expr, EventStatus)
+	if expr.Status != StatusPending {
+		return snapshot, nil, func() {}, nil
+	}
+	events, unsubscribe := o.Events.Subscribe(id)
+	return snapshot, events, unsubscribe, nil
+}
+
+// publish announces a change of the expression. The caller must hold o.Mu.
+func (o *Orchestrator) publish(expr *types.Expression, eventType string) {
+	o.Events.Publish(expressionEvent(expr, eventType))
+}
+
+func expressionEvent(expr *types.Expression, eventType string) types.ExpressionEvent {
+	return types.ExpressionEvent{
+		Type:         eventType,
+		ExpressionID: expr.ID,
+		Status:       expr.Status,
+		TasksDone:    expr.TasksDone,
+		TasksTotal:   len(expr.Tasks),
+		Result:       expr.Result,
+		Error:        expr.Error,
+	}
+}
@@ -0,0 +1,67 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+
+	errs "distr-comp/internal/orchestrator/errors"
+	store "distr-comp/internal/orchestrator/store"
+	types "distr-comp/internal/orchestrator/types"
+	utils "distr-comp/internal/orchestrator/utils"
+)
+
+// AddFormula compiles the expression once and registers it as a reusable
+// formula. Compilation errors wrap errs.ErrInvalidExpression.
+func (o *Orchestrator) AddFormula(ctx context.Context, expr string) (*types.Formula, error) {
+	rpn, err := compile(ctx, expr)
+	if err != nil {
+		return nil, err
+	}
+
+	variables := make([]string, 0)
+	for _, token := range rpn {
+		if token.Type == TokenIdentifier && !utils.Contains(variables, token.Value) {
+			variables = append(variables, token.Value)
+		}
+	}
+
+	o.Mu.Lock()
+	defer o.Mu.Unlock()
+
+	o.FormulaCounter++
+	formula := &types.Formula{
+		ID:         fmt.Sprintf("formula-%d", o.FormulaCounter),
+		Expression: expr,
+		Variables:  variables,
+		RPN:        rpn,
+	}
+	o.Formulas[formula.ID] = formula
+	o.persistRecords(store.Records{Formulas: []*types.Formula{formula}})
+	return formula, nil
+}
+
+func (o *Orchestrator) GetFormula(id string) (*types.Formula, bool) {
+	o.Mu.RLock()
+	defer o.Mu.RUnlock()
+
+	formula, exists := o.Formulas[id]
+	return formula, exists
+}
+
+// EvaluateFormula starts a new expression from the cached RPN of the formula,
+// skipping tokenization and validation.
+func (o *Orchestrator) EvaluateFormula(ctx context.Context, id string, opts ExpressionOptions) (string, error) {
+	o.Mu.Lock()
+	defer o.Mu.Unlock()
+
+	formula, exists := o.Formulas[id]
+	if !exists {
+		return "", errs.ErrFormulaNotFound
+	}
+
+	expression, err := o.instantiate(ctx, formula.RPN, opts, formula.ID)
+	if err != nil {
+		return "", err
+	}
+	return expression.ID, nil
+}
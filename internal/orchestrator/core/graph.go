@@ -0,0 +1,386 @@
+package orchestrator
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"distr-comp/internal/calc"
+	errs "distr-comp/internal/orchestrator/errors"
+	types "distr-comp/internal/orchestrator/types"
+	utils "distr-comp/internal/orchestrator/utils"
+)
+
+// node is an operation in the expression tree built from RPN. Literals are
+// nodes without an operation.
+type node struct {
+	op    string
+	value string
+	args  []*node
+}
+
+func literal(value string) *node {
+	return &node{value: value}
+}
+
+func (n *node) isLiteral() bool {
+	return n.op == ""
+}
+
+// buildTree turns RPN into an expression tree, substituting variables and
+// folding signs of literals.
+func buildTree(tokens []types.Token, variables map[string]float64) (*node, error) {
+	var stack []*node
+
+	pop := func(count int) []*node {
+		args := make([]*node, count)
+		copy(args, stack[len(stack)-count:])
+		stack = stack[:len(stack)-count]
+		return args
+	}
+
+	for _, token := range tokens {
+		switch token.Type {
+		case TokenNumber:
+			if _, err := strconv.ParseFloat(token.Value, 64); err != nil {
+				return nil, fmt.Errorf("%w '%s' at position %d", errs.ErrInvalidNumber, token.Value, token.Pos)
+			}
+			stack = append(stack, literal(token.Value))
+		case TokenIdentifier:
+			value, bound := variables[token.Value]
+			if !bound {
+				return nil, fmt.Errorf("%w '%s' at position %d", errs.ErrUnboundVariable, token.Value, token.Pos)
+			}
+			stack = append(stack, literal(strconv.FormatFloat(value, 'f', -1, 64)))
+		case TokenOperator:
+			if token.IsUnary {
+				if len(stack) < 1 {
+					return nil, fmt.Errorf("unary operator '%s' is missing an operand", token.Value)
+				}
+				if token.Value == "+" {
+					continue
+				}
+
+				operand := stack[len(stack)-1]
+				if operand.isLiteral() {
+					stack[len(stack)-1] = literal(negateLiteral(operand.value))
+				} else {
+					stack[len(stack)-1] = &node{op: OperationNegate, args: []*node{operand}}
+				}
+				continue
+			}
+
+			if len(stack) < 2 {
+				return nil, fmt.Errorf("operator '%s' is missing an operand", token.Value)
+			}
+			stack = append(stack, &node{op: token.Value, args: pop(2)})
+		case TokenFunction:
+			if len(stack) < token.ArgCount {
+				return nil, fmt.Errorf("function '%s' is missing arguments", token.Value)
+			}
+			stack = append(stack, &node{op: token.Value, args: pop(token.ArgCount)})
+		}
+	}
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("malformed expression: %d values left after parsing", len(stack))
+	}
+	return stack[0], nil
+}
+
+// rebalance rewrites chains of the same associative and commutative
+// operator, such as 1+2+3+4+5+6+7+8, into balanced trees so that agents can
+// run their parts in parallel. Operands are combined cheapest first, which
+// keeps the critical path as short as possible even when they are subtrees of
+// different depth. Floating-point results may differ from strict left-to-right
+// evaluation. It returns the critical-path length of n in milliseconds.
+func (o *Orchestrator) rebalance(n *node) time.Duration {
+	if n.isLiteral() {
+		return 0
+	}
+
+	if !isAssociative(n.op) {
+		var longest time.Duration
+		for _, arg := range n.args {
+			longest = max(longest, o.rebalance(arg))
+		}
+		return longest + o.OperationTimes[n.op]
+	}
+
+	var operands operandQueue
+	for _, operand := range flattenChain(n, n.op, nil) {
+		heap.Push(&operands, weightedNode{node: operand, cost: o.rebalance(operand), seq: len(operands)})
+	}
+
+	seq := operands.Len()
+	for operands.Len() > 2 {
+		a := heap.Pop(&operands).(weightedNode)
+		b := heap.Pop(&operands).(weightedNode)
+		combined := &node{op: n.op, args: []*node{a.node, b.node}}
+		heap.Push(&operands, weightedNode{node: combined, cost: max(a.cost, b.cost) + o.OperationTimes[n.op], seq: seq})
+		seq++
+	}
+
+	a := heap.Pop(&operands).(weightedNode)
+	b := heap.Pop(&operands).(weightedNode)
+	n.args = []*node{a.node, b.node}
+	return max(a.cost, b.cost) + o.OperationTimes[n.op]
+}
+
+// estimateDuration returns the shortest time, in milliseconds, in which the
+// agents could compute n: its critical path, or its total work spread over
+// capacity workers when that takes longer. A capacity of zero means unknown
+// and only the critical path counts.
+func (o *Orchestrator) estimateDuration(n *node, capacity int) time.Duration {
+	var walk func(n *node) (critical, work time.Duration)
+	walk = func(n *node) (time.Duration, time.Duration) {
+		if n.isLiteral() {
+			return 0, 0
+		}
+		var critical, work time.Duration
+		for _, arg := range n.args {
+			c, w := walk(arg)
+			critical = max(critical, c)
+			work += w
+		}
+		return critical + o.OperationTimes[n.op], work + o.OperationTimes[n.op]
+	}
+
+	critical, work := walk(n)
+	if capacity > 0 {
+		return max(critical, work/time.Duration(capacity))
+	}
+	return critical
+}
+
+func isAssociative(op string) bool {
+	return op == "+" || op == "*"
+}
+
+// flattenChain collects the operands of the maximal subtree of n built only
+// from op, in left-to-right order.
+func flattenChain(n *node, op string, operands []*node) []*node {
+	if n.op != op {
+		return append(operands, n)
+	}
+	for _, arg := range n.args {
+		operands = flattenChain(arg, op, operands)
+	}
+	return operands
+}
+
+type weightedNode struct {
+	node *node
+	cost time.Duration
+	seq  int
+}
+
+// operandQueue is a min-heap of nodes by critical-path cost; ties keep the
+// original order so the rewrite is deterministic.
+type operandQueue []weightedNode
+
+func (q operandQueue) Len() int { return len(q) }
+func (q operandQueue) Less(i, j int) bool {
+	if q[i].cost != q[j].cost {
+		return q[i].cost < q[j].cost
+	}
+	return q[i].seq < q[j].seq
+}
+func (q operandQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *operandQueue) Push(x interface{}) { *q = append(*q, x.(weightedNode)) }
+func (q *operandQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// foldConstants evaluates in place every operation whose arguments are all
+// literals and which is cheap enough to run on the orchestrator. Operations
+// that fail, e.g. division by zero, are left for the agents so the failure is
+// reported the usual way. It returns the number of folded operations.
+func (o *Orchestrator) foldConstants(n *node) int {
+	if n.isLiteral() {
+		return 0
+	}
+
+	folded := 0
+	allLiterals := true
+	for _, arg := range n.args {
+		folded += o.foldConstants(arg)
+		allLiterals = allLiterals && arg.isLiteral()
+	}
+	if !allLiterals || !o.runsLocally(n.op) {
+		return folded
+	}
+
+	values := make([]float64, 0, len(n.args))
+	for _, arg := range n.args {
+		value, err := strconv.ParseFloat(arg.value, 64)
+		if err != nil {
+			return folded
+		}
+		values = append(values, value)
+	}
+
+	result, err := calc.Apply(n.op, values)
+	if err != nil {
+		return folded
+	}
+	*n = *literal(strconv.FormatFloat(result, 'f', -1, 64))
+	return folded + 1
+}
+
+// emitTasks creates one task per distinct operation of the tree,
+// dependencies first, and returns the tasks with the argument that holds the
+// final result: a task ID, or a literal when the whole tree was folded.
+// Identical subexpressions, e.g. both sides of "(2*3)+(2*3)", share a single
+// task whose result fans out to every dependent.
+func (o *Orchestrator) emitTasks(root *node, exprID string) ([]*types.Task, string) {
+	var tasks []*types.Task
+	emitted := make(map[string]string)
+
+	var emit func(n *node) string
+	emit = func(n *node) string {
+		if n.isLiteral() {
+			return n.value
+		}
+
+		args := make([]string, 0, len(n.args))
+		for _, arg := range n.args {
+			args = append(args, emit(arg))
+		}
+
+		key := subexpressionKey(n.op, args)
+		if taskID, exists := emitted[key]; exists {
+			return taskID
+		}
+
+		deps := make([]string, 0)
+		for _, arg := range args {
+			if !utils.IsNumber(arg) && !utils.Contains(deps, arg) {
+				deps = append(deps, arg)
+			}
+		}
+
+		o.TaskCounter++
+		task := &types.Task{
+			ID:           fmt.Sprintf("task-%d", o.TaskCounter),
+			Seq:          o.TaskCounter,
+			ExpressionID: exprID,
+			Args:         args,
+			Operation:    n.op,
+			Dependencies: deps,
+			Status:       StatusPending,
+		}
+		tasks = append(tasks, task)
+		emitted[key] = task.ID
+		return task.ID
+	}
+
+	rootArg := emit(root)
+	o.rankCriticalPaths(tasks)
+	return tasks, rootArg
+}
+
+// rankCriticalPaths sets the CriticalPath of every task: the time, in
+// milliseconds, from the start of the task to the end of the expression if
+// agents ran everything after it without waiting. Tasks must be in emission
+// order, dependencies first.
+func (o *Orchestrator) rankCriticalPaths(tasks []*types.Task) {
+	index := make(map[string]*types.Task, len(tasks))
+	for _, task := range tasks {
+		index[task.ID] = task
+		task.CriticalPath = 0
+	}
+
+	// Walking backwards visits every dependent before its dependencies, at
+	// which point CriticalPath holds the longest path after the task.
+	for i := len(tasks) - 1; i >= 0; i-- {
+		task := tasks[i]
+		task.CriticalPath += int(o.OperationTimes[task.Operation])
+		for _, dep := range task.Dependencies {
+			if t, exists := index[dep]; exists {
+				t.CriticalPath = max(t.CriticalPath, task.CriticalPath)
+			}
+		}
+	}
+}
+
+// subexpressionKey identifies an operation by what it computes. Arguments are
+// task IDs, which are already shared, or literals, which are normalised so
+// that "2" and "2.0" match. Arguments of commutative operations are sorted.
+func subexpressionKey(op string, args []string) string {
+	normalized := make([]string, 0, len(args))
+	for _, arg := range args {
+		if value, err := strconv.ParseFloat(arg, 64); err == nil {
+			arg = strconv.FormatFloat(value, 'g', -1, 64)
+		}
+		normalized = append(normalized, arg)
+	}
+
+	switch op {
+	case "+", "*", "min", "max":
+		sort.Strings(normalized)
+	}
+	return op + "(" + strings.Join(normalized, ",") + ")"
+}
+
+// runsLocally reports whether op is cheap enough to be evaluated by the
+// orchestrator itself instead of being shipped to an agent.
+func (o *Orchestrator) runsLocally(op string) bool {
+	return o.OperationTimes[op] < o.LocalEvalThreshold
+}
+
+func negateLiteral(value string) string {
+	number, _ := strconv.ParseFloat(value, 64)
+	return strconv.FormatFloat(-number, 'f', -1, 64)
+}
+
+// ExpressionGraph returns the task DAG of the expression. Dependencies are
+// derived from the task arguments, since Task.Dependencies only holds the
+// unresolved ones.
+func (o *Orchestrator) ExpressionGraph(id string) (*types.ExpressionGraph, error) {
+	o.Mu.RLock()
+	defer o.Mu.RUnlock()
+
+	expr, exists := o.Expressions[id]
+	if !exists {
+		return nil, errs.ErrExpressionNotFound
+	}
+
+	graph := &types.ExpressionGraph{
+		Expression: expressionResponse(expr),
+		Tasks:      make([]types.TaskNode, 0, len(expr.Tasks)),
+	}
+	for _, task := range expr.Tasks {
+		deps := make([]string, 0)
+		for _, arg := range task.Args {
+			if !utils.IsNumber(arg) && !utils.Contains(deps, arg) {
+				deps = append(deps, arg)
+			}
+		}
+		graph.Tasks = append(graph.Tasks, types.TaskNode{
+			ID:            task.ID,
+			Operation:     task.Operation,
+			Args:          task.Args,
+			Dependencies:  deps,
+			Status:        task.Status,
+			AgentID:       task.AgentID,
+			Attempts:      task.Attempts,
+			OperationTime: int(o.OperationTimes[task.Operation]),
+			CriticalPath:  task.CriticalPath,
+			ReadyAt:       task.ReadyAt,
+			DispatchedAt:  task.DispatchedAt,
+			ResultAt:      task.ResultAt,
+			Result:        task.Result,
+			Error:         task.Error,
+		})
+	}
+	if len(expr.Tasks) > 0 {
+		graph.Root = expr.Tasks[len(expr.Tasks)-1].ID
+	}
+	return graph, nil
+}
@@ -0,0 +1,189 @@
+package orchestrator
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	errs "distr-comp/internal/orchestrator/errors"
+	types "distr-comp/internal/orchestrator/types"
+)
+
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// ExpressionQuery selects a page of expressions ordered by creation time.
+type ExpressionQuery struct {
+	// Statuses keeps only expressions in one of the statuses; empty means
+	// any.
+	Statuses []string
+	// CreatedAfter and CreatedBefore, when set, keep expressions created
+	// strictly after or before the time.
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// Descending lists the newest expressions first.
+	Descending bool
+	// Cursor is the NextCursor of the previous page; empty starts from the
+	// beginning.
+	Cursor string
+	// Limit is the page size: DefaultListLimit when zero, at most
+	// MaxListLimit.
+	Limit int
+}
+
+// indexExpression adds the expression to the creation-time index and to
+// the index of its status. New expressions normally go to the end. The
+// caller must hold o.Mu.
+func (o *Orchestrator) indexExpression(expr *types.Expression) {
+	o.byCreation = insertByCreation(o.byCreation, expr)
+	o.byStatus[expr.Status] = insertByCreation(o.byStatus[expr.Status], expr)
+}
+
+// reindexStatus moves the expression from the index of status from to the
+// index of its current status. The caller must hold o.Mu.
+func (o *Orchestrator) reindexStatus(expr *types.Expression, from string) {
+	index := o.byStatus[from]
+	i := sort.Search(len(index), func(i int) bool { return !olderThan(index[i], expr) })
+	if i < len(index) && index[i] == expr {
+		o.byStatus[from] = slices.Delete(index, i, i+1)
+	}
+	o.byStatus[expr.Status] = insertByCreation(o.byStatus[expr.Status], expr)
+}
+
+func insertByCreation(index []*types.Expression, expr *types.Expression) []*types.Expression {
+	i := sort.Search(len(index), func(i int) bool { return olderThan(expr, index[i]) })
+	return slices.Insert(index, i, expr)
+}
+
+// ListExpressions returns a page of the expressions matching the query and
+// the cursor of the next page, empty on the last one. The page is read from
+// the creation-time index, or from the indexes of the requested statuses,
+// merged; either way only the expressions on the page are visited.
+// Pages are stable: expressions created later never shift earlier pages.
+func (o *Orchestrator) ListExpressions(q ExpressionQuery) ([]types.ExpressionResponse, string, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	limit = min(limit, MaxListLimit)
+
+	var after *types.Expression
+	if q.Cursor != "" {
+		var err error
+		if after, err = decodeCursor(q.Cursor); err != nil {
+			return nil, "", err
+		}
+	}
+
+	o.Mu.RLock()
+	defer o.Mu.RUnlock()
+
+	var windows [][]*types.Expression
+	if len(q.Statuses) == 0 {
+		windows = append(windows, window(o.byCreation, q, after))
+	}
+	for i, status := range q.Statuses {
+		if !slices.Contains(q.Statuses[:i], status) {
+			windows = append(windows, window(o.byStatus[status], q, after))
+		}
+	}
+
+	// Each window is in creation order; the page takes the next expression
+	// across all of them, from the front when ascending, from the back when
+	// descending.
+	page := make([]*types.Expression, 0, limit+1)
+	for len(page) <= limit {
+		best := -1
+		for i, w := range windows {
+			if len(w) == 0 {
+				continue
+			}
+			if best < 0 ||
+				(q.Descending && olderThan(windows[best][len(windows[best])-1], w[len(w)-1])) ||
+				(!q.Descending && olderThan(w[0], windows[best][0])) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		w := windows[best]
+		if q.Descending {
+			page = append(page, w[len(w)-1])
+			windows[best] = w[:len(w)-1]
+		} else {
+			page = append(page, w[0])
+			windows[best] = w[1:]
+		}
+	}
+
+	var next string
+	if len(page) > limit {
+		page = page[:limit]
+		next = encodeCursor(page[limit-1])
+	}
+
+	response := make([]types.ExpressionResponse, 0, len(page))
+	for _, expr := range page {
+		response = append(response, expressionResponse(expr))
+	}
+	return response, next, nil
+}
+
+// window narrows a creation-ordered index to the time range of the query
+// and to what follows the cursor expression after, if any.
+func window(index []*types.Expression, q ExpressionQuery, after *types.Expression) []*types.Expression {
+	lo, hi := 0, len(index)
+	if q.CreatedAfter != nil {
+		lo = sort.Search(len(index), func(i int) bool { return index[i].CreatedAt.After(*q.CreatedAfter) })
+	}
+	if q.CreatedBefore != nil {
+		hi = sort.Search(len(index), func(i int) bool { return !index[i].CreatedAt.Before(*q.CreatedBefore) })
+	}
+	if after != nil {
+		if q.Descending {
+			hi = min(hi, sort.Search(len(index), func(i int) bool { return !olderThan(index[i], after) }))
+		} else {
+			lo = max(lo, sort.Search(len(index), func(i int) bool { return olderThan(after, index[i]) }))
+		}
+	}
+	if lo >= hi {
+		return nil
+	}
+	return index[lo:hi]
+}
+
+// encodeCursor points right after the expression in the index.
+func encodeCursor(expr *types.Expression) string {
+	key := fmt.Sprintf("%d.%d", expr.CreatedAt.UnixNano(), expr.Seq)
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// decodeCursor returns a stand-in for the expression the cursor points
+// after, comparable with olderThan.
+func decodeCursor(cursor string) (*types.Expression, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errs.ErrInvalidCursor
+	}
+	nanos, seq, found := strings.Cut(string(key), ".")
+	if !found {
+		return nil, errs.ErrInvalidCursor
+	}
+	createdAt, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, errs.ErrInvalidCursor
+	}
+	n, err := strconv.Atoi(seq)
+	if err != nil {
+		return nil, errs.ErrInvalidCursor
+	}
+	return &types.Expression{ID: "expr-" + seq, Seq: n, CreatedAt: time.Unix(0, createdAt)}, nil
+}
@@ -0,0 +1,158 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	errs "distr-comp/internal/orchestrator/errors"
+	store "distr-comp/internal/orchestrator/store"
+)
+
+// listingOrchestrator returns an orchestrator with the pending expressions
+// expr-1 to expr-n and no agents, so they stay pending until cancelled.
+func listingOrchestrator(t *testing.T, n int) *Orchestrator {
+	t.Helper()
+	o, err := NewOrchestrator(Config{OperationTimes: map[string]time.Duration{"+": 10}}, store.NewNopStore())
+	if err != nil {
+		t.Fatalf("NewOrchestrator: %v", err)
+	}
+	for i := 1; i <= n; i++ {
+		if _, err := o.AddExpression(context.Background(), fmt.Sprintf("%d+1", i), ExpressionOptions{}); err != nil {
+			t.Fatalf("AddExpression: %v", err)
+		}
+	}
+	return o
+}
+
+func cancelExpressions(t *testing.T, o *Orchestrator, ids []string) {
+	t.Helper()
+	for _, id := range ids {
+		if _, err := o.CancelExpression(id); err != nil {
+			t.Fatalf("CancelExpression(%s): %v", id, err)
+		}
+	}
+}
+
+func TestListExpressionsPaging(t *testing.T) {
+	tests := []struct {
+		name  string
+		query ExpressionQuery
+		// cancelled are cancelled before the first page, between after it.
+		cancelled []string
+		between   []string
+		want      [][]string
+	}{
+		{
+			name:  "ascending",
+			query: ExpressionQuery{Limit: 2},
+			want:  [][]string{{"expr-1", "expr-2"}, {"expr-3", "expr-4"}, {"expr-5"}},
+		},
+		{
+			name:  "descending",
+			query: ExpressionQuery{Limit: 2, Descending: true},
+			want:  [][]string{{"expr-5", "expr-4"}, {"expr-3", "expr-2"}, {"expr-1"}},
+		},
+		{
+			name:  "last page full",
+			query: ExpressionQuery{Limit: 5},
+			want:  [][]string{{"expr-1", "expr-2", "expr-3", "expr-4", "expr-5"}},
+		},
+		{
+			name:  "limit above the total",
+			query: ExpressionQuery{Limit: MaxListLimit + 1},
+			want:  [][]string{{"expr-1", "expr-2", "expr-3", "expr-4", "expr-5"}},
+		},
+		{
+			name:      "one status",
+			query:     ExpressionQuery{Limit: 2, Statuses: []string{StatusCancelled}},
+			cancelled: []string{"expr-4", "expr-2"},
+			want:      [][]string{{"expr-2", "expr-4"}},
+		},
+		{
+			name:      "several statuses",
+			query:     ExpressionQuery{Limit: 2, Statuses: []string{StatusCancelled, StatusDone, StatusCancelled}},
+			cancelled: []string{"expr-1", "expr-3", "expr-5"},
+			want:      [][]string{{"expr-1", "expr-3"}, {"expr-5"}},
+		},
+		{
+			name:  "no match",
+			query: ExpressionQuery{Limit: 2, Statuses: []string{StatusError}},
+			want:  [][]string{{}},
+		},
+		{
+			name:    "status changes behind the cursor",
+			query:   ExpressionQuery{Limit: 2, Statuses: []string{StatusPending}},
+			between: []string{"expr-1", "expr-2"},
+			want:    [][]string{{"expr-1", "expr-2"}, {"expr-3", "expr-4"}, {"expr-5"}},
+		},
+		{
+			name:    "status changes ahead of the cursor",
+			query:   ExpressionQuery{Limit: 2, Statuses: []string{StatusPending}},
+			between: []string{"expr-3"},
+			want:    [][]string{{"expr-1", "expr-2"}, {"expr-4", "expr-5"}},
+		},
+		{
+			name:    "descending status changes ahead of the cursor",
+			query:   ExpressionQuery{Limit: 2, Statuses: []string{StatusPending}, Descending: true},
+			between: []string{"expr-3", "expr-2"},
+			want:    [][]string{{"expr-5", "expr-4"}, {"expr-1"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := listingOrchestrator(t, 5)
+			cancelExpressions(t, o, tt.cancelled)
+
+			query := tt.query
+			var pages [][]string
+			for {
+				page, next, err := o.ListExpressions(query)
+				if err != nil {
+					t.Fatalf("ListExpressions: %v", err)
+				}
+				ids := make([]string, 0, len(page))
+				for _, expr := range page {
+					ids = append(ids, expr.ID)
+				}
+				pages = append(pages, ids)
+
+				if len(pages) == 1 {
+					cancelExpressions(t, o, tt.between)
+				}
+				if next == "" {
+					break
+				}
+				if len(pages) > len(tt.want) {
+					t.Fatalf("got more than %d pages: %v", len(tt.want), pages)
+				}
+				query.Cursor = next
+			}
+
+			if !slices.EqualFunc(pages, tt.want, slices.Equal[[]string]) {
+				t.Errorf("got pages %v, want %v", pages, tt.want)
+			}
+		})
+	}
+}
+
+func TestListExpressionsRejectsBadCursor(t *testing.T) {
+	o := listingOrchestrator(t, 1)
+	encode := base64.RawURLEncoding.EncodeToString
+
+	for _, cursor := range []string{
+		"not base64!",
+		encode([]byte("12345")),
+		encode([]byte("x.1")),
+		encode([]byte("12345.x")),
+	} {
+		if _, _, err := o.ListExpressions(ExpressionQuery{Cursor: cursor}); !errors.Is(err, errs.ErrInvalidCursor) {
+			t.Errorf("cursor %q: got %v, want %v", cursor, err, errs.ErrInvalidCursor)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package orchestrator
+
+import (
+	"time"
+
+	types "distr-comp/internal/orchestrator/types"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "distrcomp"
+
+// Outcomes of submitted task results, as counted in the task_results_total
+// metric.
+const (
+	resultDone     = "done"
+	resultFailed   = "failed"
+	resultRejected = "rejected"
+)
+
+// metrics are the instruments the orchestrator updates as it works. Gauges
+// describing its current state are read at scrape time instead, see
+// metricsCollector.
+type metrics struct {
+	expressionsSubmitted prometheus.Counter
+	taskDuration         *prometheus.HistogramVec
+	taskResults          *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		expressionsSubmitted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "expressions_submitted_total",
+			Help:      "Expressions accepted for evaluation.",
+		}),
+		taskDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "task_duration_seconds",
+			Help:      "Time from handing a task to an agent until its outcome arrived.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+		}, []string{"operation"}),
+		taskResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "task_results_total",
+			Help:      "Task outcomes submitted by agents: done, failed, or rejected for a stale lease or a cancelled task.",
+		}, []string{"outcome"}),
+	}
+}
+
+// observeOutcome records an accepted task outcome.
+func (o *Orchestrator) observeOutcome(task *types.Task, outcome string) {
+	if task.DispatchedAt != nil {
+		o.metrics.taskDuration.WithLabelValues(task.Operation).Observe(time.Since(*task.DispatchedAt).Seconds())
+	}
+	o.metrics.taskResults.WithLabelValues(outcome).Inc()
+}
+
+var (
+	expressionsDesc = prometheus.NewDesc(metricsNamespace+"_expressions",
+		"Expressions by status.", []string{"status"}, nil)
+	readyTasksDesc = prometheus.NewDesc(metricsNamespace+"_ready_tasks",
+		"Tasks waiting in the ready queue for an agent.", nil, nil)
+	inProgressTasksDesc = prometheus.NewDesc(metricsNamespace+"_tasks_in_progress",
+		"Tasks leased to agents.", nil, nil)
+	agentsDesc = prometheus.NewDesc(metricsNamespace+"_agents",
+		"Registered agents.", nil, nil)
+	computingPowerDesc = prometheus.NewDesc(metricsNamespace+"_computing_power",
+		"Sum of the computing power of registered agents.", nil, nil)
+	pendingWebhooksDesc = prometheus.NewDesc(metricsNamespace+"_webhooks_pending",
+		"Webhooks waiting in the outbox.", nil, nil)
+)
+
+// metricsCollector exports the state of an orchestrator together with its
+// instruments.
+type metricsCollector struct {
+	o *Orchestrator
+}
+
+// MetricsCollector returns a Prometheus collector for the orchestrator.
+func (o *Orchestrator) MetricsCollector() prometheus.Collector {
+	return metricsCollector{o: o}
+}
+
+func (c metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- expressionsDesc
+	ch <- readyTasksDesc
+	ch <- inProgressTasksDesc
+	ch <- agentsDesc
+	ch <- computingPowerDesc
+	ch <- pendingWebhooksDesc
+	c.o.metrics.expressionsSubmitted.Describe(ch)
+	c.o.metrics.taskDuration.Describe(ch)
+	c.o.metrics.taskResults.Describe(ch)
+}
+
+func (c metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	o := c.o
+	o.Mu.RLock()
+	byStatus := make(map[string]int)
+	for _, status := range []string{StatusPending, StatusDone, StatusError, StatusCancelled} {
+		byStatus[status] = len(o.byStatus[status])
+	}
+	ready := o.Scheduler.Len()
+	inProgress := len(o.ProcessingTasks)
+	agents := len(o.Agents)
+	computingPower := o.ComputingPower
+	webhooks := len(o.Deliveries)
+	o.Mu.RUnlock()
+
+	for status, n := range byStatus {
+		ch <- prometheus.MustNewConstMetric(expressionsDesc, prometheus.GaugeValue, float64(n), status)
+	}
+	ch <- prometheus.MustNewConstMetric(readyTasksDesc, prometheus.GaugeValue, float64(ready))
+	ch <- prometheus.MustNewConstMetric(inProgressTasksDesc, prometheus.GaugeValue, float64(inProgress))
+	ch <- prometheus.MustNewConstMetric(agentsDesc, prometheus.GaugeValue, float64(agents))
+	ch <- prometheus.MustNewConstMetric(computingPowerDesc, prometheus.GaugeValue, float64(computingPower))
+	ch <- prometheus.MustNewConstMetric(pendingWebhooksDesc, prometheus.GaugeValue, float64(webhooks))
+	o.metrics.expressionsSubmitted.Collect(ch)
+	o.metrics.taskDuration.Collect(ch)
+	o.metrics.taskResults.Collect(ch)
+}
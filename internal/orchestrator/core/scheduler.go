@@ -0,0 +1,234 @@
+package orchestrator
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	types "distr-comp/internal/orchestrator/types"
+)
+
+// Fairness policies across expressions, see NewScheduler.
+const (
+	PolicyRoundRobin = "round_robin"
+	PolicyWeighted   = "weighted"
+	PolicyEDF        = "edf"
+)
+
+// MaxPriority bounds the priority of an expression so that a single one
+// cannot take practically all the agents under PolicyWeighted.
+const MaxPriority = 100
+
+// Scheduler decides which ready task is handed out next. It is only used
+// while the orchestrator lock is held and needs no locking of its own.
+type Scheduler interface {
+	// Push adds a ready task of expr.
+	Push(task *types.Task, expr *types.Expression)
+	// Pop removes and returns the next task, or nil when there is none. The
+	// task may no longer be ready, callers must check its status.
+	Pop() *types.Task
+	// Len returns the number of queued tasks.
+	Len() int
+	// RemoveExpression drops every queued task of the expression and returns
+	// how many there were.
+	RemoveExpression(exprID string) int
+}
+
+// NewScheduler returns a priority scheduler. Within an expression, tasks with
+// the longest remaining critical path go first. Across expressions, the
+// policy decides:
+//   - round_robin: expressions take turns, older ones first;
+//   - weighted: expressions get shares proportional to priority+1;
+//   - edf: the expression with the earliest deadline goes first, then the
+//     one with the highest priority. Expressions without a deadline come
+//     last.
+//
+// Ties go to the oldest expression.
+func NewScheduler(policy string) (Scheduler, error) {
+	switch policy {
+	case PolicyRoundRobin, PolicyWeighted, PolicyEDF:
+	default:
+		return nil, fmt.Errorf("unknown scheduling policy %q", policy)
+	}
+
+	return &priorityScheduler{
+		policy: policy,
+		queues: make(map[string]*expressionQueue),
+	}, nil
+}
+
+type priorityScheduler struct {
+	policy string
+	queues map[string]*expressionQueue
+	// active holds the queues that have tasks, ordered by the policy.
+	active expressionHeap
+	size   int
+	// turn counts pops for round robin; pass is the virtual time of the
+	// weighted policy.
+	turn uint64
+	pass float64
+}
+
+// expressionQueue holds the ready tasks of one expression.
+type expressionQueue struct {
+	expr       *types.Expression
+	tasks      taskHeap
+	index      int
+	lastServed uint64
+	pass       float64
+}
+
+func (s *priorityScheduler) Push(task *types.Task, expr *types.Expression) {
+	queue, exists := s.queues[expr.ID]
+	if !exists {
+		queue = &expressionQueue{expr: expr, index: -1}
+		s.queues[expr.ID] = queue
+	}
+
+	heap.Push(&queue.tasks, task)
+	s.size++
+
+	if queue.index < 0 {
+		// A queue joining the competition must not claim the shares it did
+		// not use while it was idle.
+		queue.pass = max(queue.pass, s.pass)
+		s.active.policy = s.policy
+		heap.Push(&s.active, queue)
+	}
+}
+
+func (s *priorityScheduler) Pop() *types.Task {
+	if s.active.Len() == 0 {
+		return nil
+	}
+
+	queue := s.active.queues[0]
+	task := heap.Pop(&queue.tasks).(*types.Task)
+	s.size--
+
+	s.turn++
+	queue.lastServed = s.turn
+	s.pass = queue.pass
+	queue.pass += 1 / float64(weight(queue.expr))
+
+	if queue.tasks.Len() == 0 {
+		heap.Remove(&s.active, queue.index)
+		delete(s.queues, queue.expr.ID)
+	} else {
+		heap.Fix(&s.active, queue.index)
+	}
+	return task
+}
+
+func (s *priorityScheduler) Len() int {
+	return s.size
+}
+
+func (s *priorityScheduler) RemoveExpression(exprID string) int {
+	queue, exists := s.queues[exprID]
+	if !exists {
+		return 0
+	}
+
+	if queue.index >= 0 {
+		heap.Remove(&s.active, queue.index)
+	}
+	delete(s.queues, exprID)
+	s.size -= queue.tasks.Len()
+	return queue.tasks.Len()
+}
+
+func weight(expr *types.Expression) int {
+	return min(max(expr.Priority, 0), MaxPriority) + 1
+}
+
+// taskHeap orders the tasks of one expression by remaining critical path,
+// longest first, and then by ID order.
+type taskHeap []*types.Task
+
+func (h taskHeap) Len() int { return len(h) }
+func (h taskHeap) Less(i, j int) bool {
+	if h[i].CriticalPath != h[j].CriticalPath {
+		return h[i].CriticalPath > h[j].CriticalPath
+	}
+	return h[i].Seq < h[j].Seq
+}
+func (h taskHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *taskHeap) Push(x interface{}) { *h = append(*h, x.(*types.Task)) }
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	task := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return task
+}
+
+// expressionHeap orders expression queues according to the policy.
+type expressionHeap struct {
+	policy string
+	queues []*expressionQueue
+}
+
+func (h expressionHeap) Len() int { return len(h.queues) }
+func (h expressionHeap) Less(i, j int) bool {
+	a, b := h.queues[i], h.queues[j]
+	switch h.policy {
+	case PolicyRoundRobin:
+		if a.lastServed != b.lastServed {
+			return a.lastServed < b.lastServed
+		}
+	case PolicyWeighted:
+		if a.pass != b.pass {
+			return a.pass < b.pass
+		}
+	case PolicyEDF:
+		if !deadline(a.expr).Equal(deadline(b.expr)) {
+			return deadline(a.expr).Before(deadline(b.expr))
+		}
+		if a.expr.Priority != b.expr.Priority {
+			return a.expr.Priority > b.expr.Priority
+		}
+	}
+	return olderThan(a.expr, b.expr)
+}
+func (h expressionHeap) Swap(i, j int) {
+	h.queues[i], h.queues[j] = h.queues[j], h.queues[i]
+	h.queues[i].index = i
+	h.queues[j].index = j
+}
+func (h *expressionHeap) Push(x interface{}) {
+	queue := x.(*expressionQueue)
+	queue.index = len(h.queues)
+	h.queues = append(h.queues, queue)
+}
+func (h *expressionHeap) Pop() interface{} {
+	old := h.queues
+	queue := old[len(old)-1]
+	queue.index = -1
+	h.queues = old[:len(old)-1]
+	return queue
+}
+
+// farFuture stands in for the deadline of expressions that have none.
+var farFuture = time.Unix(1<<62, 0)
+
+func deadline(expr *types.Expression) time.Time {
+	if expr.Deadline == nil {
+		return farFuture
+	}
+	return *expr.Deadline
+}
+
+func olderThan(a, b *types.Expression) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.Seq < b.Seq
+}
+
+// parseSeq returns the number in an ID such as "task-12" or "expr-3".
+func parseSeq(id string) int {
+	seq, _ := strconv.Atoi(id[strings.LastIndexByte(id, '-')+1:])
+	return seq
+}
@@ -0,0 +1,161 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	types "distr-comp/internal/orchestrator/types"
+)
+
+// schedulingFixture compiles expressions into task DAGs, without
+// rebalancing, and queues their ready tasks on a scheduler.
+type schedulingFixture struct {
+	t         *testing.T
+	o         *Orchestrator
+	scheduler Scheduler
+	created   time.Time
+}
+
+func newSchedulingFixture(t *testing.T, policy string) *schedulingFixture {
+	scheduler, err := NewScheduler(policy)
+	if err != nil {
+		t.Fatalf("NewScheduler(%s): %v", policy, err)
+	}
+	return &schedulingFixture{
+		t: t,
+		o: &Orchestrator{OperationTimes: map[string]time.Duration{
+			"+": 10, "*": 10, "^": 10,
+		}},
+		scheduler: scheduler,
+		created:   time.Unix(1700000000, 0),
+	}
+}
+
+// add queues the ready tasks of a new expression, created after the
+// previous one.
+func (f *schedulingFixture) add(source string, priority int, deadline *time.Time) {
+	f.t.Helper()
+	rpn, err := compile(context.Background(), source)
+	if err != nil {
+		f.t.Fatalf("compile(%q): %v", source, err)
+	}
+	tree, err := buildTree(rpn, nil)
+	if err != nil {
+		f.t.Fatalf("buildTree(%q): %v", source, err)
+	}
+
+	f.o.ExpressionCounter++
+	f.created = f.created.Add(time.Second)
+	expr := &types.Expression{
+		ID:        fmt.Sprintf("expr-%d", f.o.ExpressionCounter),
+		Seq:       f.o.ExpressionCounter,
+		Priority:  priority,
+		Deadline:  deadline,
+		CreatedAt: f.created,
+	}
+	expr.Tasks, _ = f.o.emitTasks(tree, expr.ID)
+	for _, task := range expr.Tasks {
+		if len(task.Dependencies) == 0 {
+			f.scheduler.Push(task, expr)
+		}
+	}
+}
+
+// order pops every queued task and returns their IDs.
+func (f *schedulingFixture) order() []string {
+	var ids []string
+	for task := f.scheduler.Pop(); task != nil; task = f.scheduler.Pop() {
+		ids = append(ids, task.ID)
+	}
+	return ids
+}
+
+func TestSchedulerDispatchOrder(t *testing.T) {
+	soon := time.Unix(1700001000, 0)
+	later := time.Unix(1700002000, 0)
+
+	tests := []struct {
+		name   string
+		policy string
+		setup  func(f *schedulingFixture)
+		want   []string
+	}{
+		{
+			// task-1 is 1*2 with 20ms left on its path, task-2 is 4^5
+			// with 30ms: 3^task-2, then the sum.
+			name:   "longest critical path first",
+			policy: PolicyWeighted,
+			setup:  func(f *schedulingFixture) { f.add("(1*2)+3^4^5", 0, nil) },
+			want:   []string{"task-2", "task-1"},
+		},
+		{
+			// task-4, 5*6, is one addition closer to the end.
+			name:   "equal paths in ID order",
+			policy: PolicyWeighted,
+			setup:  func(f *schedulingFixture) { f.add("(1*2)+(3*4)+(5*6)", 0, nil) },
+			want:   []string{"task-1", "task-2", "task-4"},
+		},
+		{
+			name:   "round robin takes turns, oldest first",
+			policy: PolicyRoundRobin,
+			setup: func(f *schedulingFixture) {
+				f.add("(1*2)+(3*4)", 5, nil)
+				f.add("(5*6)+(7*8)", 0, nil)
+			},
+			want: []string{"task-1", "task-4", "task-2", "task-5"},
+		},
+		{
+			name:   "weighted shares follow priority",
+			policy: PolicyWeighted,
+			setup: func(f *schedulingFixture) {
+				f.add("(1*2)+(3*4)+(5*6)+(7*8)", 0, nil)
+				f.add("(1*3)+(3*5)+(5*7)+(7*9)", 2, nil)
+			},
+			// Within a pass of 1, the second expression gets 3 tasks
+			// for every one of the first.
+			want: []string{"task-1", "task-8", "task-9", "task-11", "task-2", "task-13", "task-4", "task-6"},
+		},
+		{
+			name:   "edf by priority, then age",
+			policy: PolicyEDF,
+			setup: func(f *schedulingFixture) {
+				f.add("1*2", 0, nil)
+				f.add("3*4", 1, nil)
+				f.add("5*6", 1, nil)
+			},
+			want: []string{"task-2", "task-3", "task-1"},
+		},
+		{
+			name:   "edf by deadline before priority",
+			policy: PolicyEDF,
+			setup: func(f *schedulingFixture) {
+				f.add("1*2", 9, nil)
+				f.add("3*4", 0, &later)
+				f.add("5*6", 0, &soon)
+			},
+			want: []string{"task-3", "task-2", "task-1"},
+		},
+		{
+			name:   "deadlines do not jump the queue outside edf",
+			policy: PolicyRoundRobin,
+			setup: func(f *schedulingFixture) {
+				f.add("(1*2)+(3*4)", 0, nil)
+				f.add("(5*6)+(7*8)", 0, &soon)
+			},
+			want: []string{"task-1", "task-4", "task-2", "task-5"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newSchedulingFixture(t, tt.policy)
+			tt.setup(f)
+			if got := f.order(); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
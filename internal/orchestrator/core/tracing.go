@@ -0,0 +1,46 @@
+package orchestrator
+
+import (
+	"context"
+
+	types "distr-comp/internal/orchestrator/types"
+	"distr-comp/internal/tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("distr-comp/internal/orchestrator")
+
+// startTaskSpan opens the span of a task leased to an agent, as a child of
+// the request that submitted its expression. The agent continues the trace
+// from task.TraceParent. The caller must hold o.Mu.
+func (o *Orchestrator) startTaskSpan(task *types.Task, expr *types.Expression) {
+	ctx := tracing.Extract(context.Background(), expr.TraceParent)
+	ctx, span := tracer.Start(ctx, "task "+task.Operation, trace.WithAttributes(
+		attribute.String("expression.id", expr.ID),
+		attribute.String("task.id", task.ID),
+		attribute.String("task.operation", task.Operation),
+		attribute.Int("task.attempt", task.Attempts),
+		attribute.String("agent.id", task.AgentID),
+	))
+	o.taskSpans[task.ID] = span
+	task.TraceParent = tracing.Inject(ctx)
+}
+
+// endTaskSpan closes the span of a task whose lease ended, with failure as
+// the error when the task didn't complete. The caller must hold o.Mu.
+func (o *Orchestrator) endTaskSpan(task *types.Task, failure string) {
+	span, exists := o.taskSpans[task.ID]
+	if !exists {
+		return
+	}
+	if failure != "" {
+		span.SetStatus(codes.Error, failure)
+	}
+	span.End()
+	delete(o.taskSpans, task.ID)
+	task.TraceParent = ""
+}
@@ -0,0 +1,258 @@
+package orchestrator
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	logger "distr-comp/internal/logger"
+	errs "distr-comp/internal/orchestrator/errors"
+	store "distr-comp/internal/orchestrator/store"
+	types "distr-comp/internal/orchestrator/types"
+)
+
+const (
+	// SignatureHeader carries "sha256=" followed by the hex HMAC-SHA256 of
+	// the TimestampHeader value, a dot and the webhook body, keyed with
+	// Config.WebhookSecret.
+	SignatureHeader = "X-Signature-256"
+	// TimestampHeader carries the Unix time, in seconds, of the attempt.
+	// It is signed with the body so that receivers can reject stale
+	// deliveries replayed by a third party.
+	TimestampHeader = "X-Webhook-Timestamp"
+	// DeliveryHeader carries the delivery ID. It stays the same across
+	// retries, so receivers can drop duplicates.
+	DeliveryHeader = "X-Delivery-ID"
+
+	webhookTimeout     = 10 * time.Second
+	webhookMinBackoff  = time.Second
+	webhookMaxBackoff  = 10 * time.Minute
+	webhookMaxAttempts = 15
+)
+
+// validateCallbackURL accepts absolute http and https URLs, except those
+// naming an internal address directly. Host names are checked when webhooks
+// are sent, see checkWebhookAddress.
+func (o *Orchestrator) validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errs.ErrInvalidCallbackURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: %q is not an absolute http(s) URL", errs.ErrInvalidCallbackURL, raw)
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !o.webhookAddressAllowed(addr) {
+		return fmt.Errorf("%w: %s is an internal address", errs.ErrInvalidCallbackURL, addr)
+	}
+	return nil
+}
+
+// webhookAddressAllowed keeps webhooks away from the orchestrator's own
+// network: loopback, private, link-local (including cloud metadata
+// endpoints) and other non-public addresses are refused unless they belong
+// to Config.WebhookAllowedNetworks.
+func (o *Orchestrator) webhookAddressAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, network := range o.webhookAllowedNetworks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
+
+// checkWebhookAddress is the dialer hook of the webhook client. It sees the
+// resolved address of every connection, redirects included, so host names
+// pointing at internal addresses are refused as well.
+func (o *Orchestrator) checkWebhookAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !o.webhookAddressAllowed(addrPort.Addr()) {
+		return fmt.Errorf("refusing to send a webhook to internal address %s", addrPort.Addr())
+	}
+	return nil
+}
+
+// webhookClient sends webhooks directly, bypassing any proxy, so that
+// checkWebhookAddress sees the real destination.
+func (o *Orchestrator) webhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: o.checkWebhookAddress}
+	return &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+}
+
+// queueWebhook puts the final state of the expression in the outbox when it
+// has a callback URL. The delivery is saved by the next persist, together
+// with the expression. The caller must hold o.Mu.
+func (o *Orchestrator) queueWebhook(expr *types.Expression) {
+	if expr.CallbackURL == "" {
+		return
+	}
+
+	payload, err := json.Marshal(expressionResponse(expr))
+	if err != nil {
+		logger.Errorf("Failed to encode the webhook of expression %s: %v", expr.ID, err)
+		return
+	}
+
+	o.DeliveryCounter++
+	delivery := &types.Delivery{
+		ID:           fmt.Sprintf("delivery-%d", o.DeliveryCounter),
+		ExpressionID: expr.ID,
+		URL:          expr.CallbackURL,
+		Payload:      payload,
+		NextAttempt:  time.Now(),
+	}
+	o.Deliveries[delivery.ID] = delivery
+	o.unsavedDeliveries = append(o.unsavedDeliveries, delivery)
+}
+
+// wakeWebhooks makes runWebhooks look for due deliveries.
+func (o *Orchestrator) wakeWebhooks() {
+	select {
+	case o.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+type deliveryResult struct {
+	delivery *types.Delivery
+	err      error
+}
+
+// runWebhooks sends due deliveries, each in its own goroutine so that a slow
+// receiver doesn't hold up the others, and reschedules the failed ones.
+func (o *Orchestrator) runWebhooks() {
+	client := o.webhookClient()
+	inFlight := make(map[string]bool)
+	results := make(chan deliveryResult)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-o.webhookWake:
+		case result := <-results:
+			delete(inFlight, result.delivery.ID)
+			o.recordDelivery(result.delivery, result.err, time.Now())
+		}
+
+		due, next := o.dueDeliveries(time.Now(), inFlight)
+		for _, delivery := range due {
+			inFlight[delivery.ID] = true
+			go func() {
+				results <- deliveryResult{delivery: delivery, err: o.deliver(client, delivery)}
+			}()
+		}
+		if next.IsZero() {
+			timer.Reset(webhookMaxBackoff)
+		} else {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// dueDeliveries returns the deliveries to send now and the time of the next
+// one after that, zero if there is none.
+func (o *Orchestrator) dueDeliveries(now time.Time, inFlight map[string]bool) ([]*types.Delivery, time.Time) {
+	o.Mu.RLock()
+	defer o.Mu.RUnlock()
+
+	var due []*types.Delivery
+	var next time.Time
+	for _, delivery := range o.Deliveries {
+		if inFlight[delivery.ID] {
+			continue
+		}
+		if !delivery.NextAttempt.After(now) {
+			due = append(due, delivery)
+		} else if next.IsZero() || delivery.NextAttempt.Before(next) {
+			next = delivery.NextAttempt
+		}
+	}
+	return due, next
+}
+
+// deliver POSTs the payload to the callback URL. Any answer but 2xx is a
+// failure.
+func (o *Orchestrator) deliver(client *http.Client, delivery *types.Delivery) error {
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	if o.WebhookSecret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+SignPayload(o.WebhookSecret, timestamp, delivery.Payload))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback answered %s", resp.Status)
+	}
+	return nil
+}
+
+// recordDelivery removes a sent delivery from the outbox, or schedules the
+// next attempt with exponential backoff. Deliveries that keep failing are
+// dropped after webhookMaxAttempts attempts.
+func (o *Orchestrator) recordDelivery(delivery *types.Delivery, err error, now time.Time) {
+	o.Mu.Lock()
+	defer o.Mu.Unlock()
+
+	delivery.Attempts++
+	if err == nil || delivery.Attempts >= webhookMaxAttempts {
+		if err == nil {
+			logger.Infof("Delivered webhook %s of expression %s", delivery.ID, delivery.ExpressionID)
+		} else {
+			logger.Errorf("Giving up on webhook %s of expression %s after %d attempts: %v",
+				delivery.ID, delivery.ExpressionID, delivery.Attempts, err)
+		}
+		delete(o.Deliveries, delivery.ID)
+		o.persistRecords(store.Records{DeletedDeliveries: []string{delivery.ID}})
+		return
+	}
+
+	backoff := webhookMaxBackoff
+	if shift := delivery.Attempts - 1; shift < 20 {
+		backoff = min(webhookMinBackoff<<shift, webhookMaxBackoff)
+	}
+	delivery.NextAttempt = now.Add(backoff)
+	o.persistRecords(store.Records{Deliveries: []*types.Delivery{delivery}})
+
+	logger.Warnf("Webhook %s of expression %s failed (attempt %d), retrying in %v: %v",
+		delivery.ID, delivery.ExpressionID, delivery.Attempts, backoff, err)
+}
+
+// SignPayload returns the hex HMAC-SHA256 of timestamp + "." + payload, as
+// sent in SignatureHeader.
+func SignPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
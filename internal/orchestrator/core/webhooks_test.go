@@ -0,0 +1,114 @@
+package orchestrator
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	errs "distr-comp/internal/orchestrator/errors"
+)
+
+func TestWebhookAddressAllowed(t *testing.T) {
+	o := &Orchestrator{}
+	for addr, want := range map[string]bool{
+		"127.0.0.1":              false,
+		"127.1.2.3":              false,
+		"::1":                    false,
+		"10.0.0.1":               false,
+		"172.16.0.1":             false,
+		"192.168.1.1":            false,
+		"fd00::1":                false,
+		"169.254.169.254":        false,
+		"fe80::1":                false,
+		"0.0.0.0":                false,
+		"::":                     false,
+		"224.0.0.1":              false,
+		"::ffff:127.0.0.1":       false,
+		"::ffff:169.254.169.254": false,
+		"::ffff:10.0.0.1":        false,
+		"93.184.216.34":          true,
+		"::ffff:93.184.216.34":   true,
+		"2606:4700::1111":        true,
+	} {
+		if got := o.webhookAddressAllowed(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("webhookAddressAllowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	o.webhookAllowedNetworks = []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}
+	if !o.webhookAddressAllowed(netip.MustParseAddr("::ffff:10.1.2.3")) {
+		t.Error("an address in WebhookAllowedNetworks was refused")
+	}
+	if o.webhookAddressAllowed(netip.MustParseAddr("10.2.0.1")) {
+		t.Error("an address outside WebhookAllowedNetworks was allowed")
+	}
+}
+
+func TestValidateCallbackURLRefusesInternalAddresses(t *testing.T) {
+	o := &Orchestrator{}
+	for _, raw := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+		"https://10.0.0.1/hook",
+	} {
+		if err := o.validateCallbackURL(raw); !errors.Is(err, errs.ErrInvalidCallbackURL) {
+			t.Errorf("validateCallbackURL(%s): got %v, want %v", raw, err, errs.ErrInvalidCallbackURL)
+		}
+	}
+	if err := o.validateCallbackURL("https://hooks.example.com/expr"); err != nil {
+		t.Errorf("validateCallbackURL of a public host: %v", err)
+	}
+}
+
+func TestWebhookClientRefusesInternalAddresses(t *testing.T) {
+	var received atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer receiver.Close()
+	port := receiver.URL[strings.LastIndexByte(receiver.URL, ':'):]
+
+	o := &Orchestrator{}
+	client := o.webhookClient()
+	for _, url := range []string{
+		receiver.URL,
+		// Host names are checked once resolved.
+		"http://localhost" + port,
+		"http://169.254.169.254/latest/meta-data/",
+	} {
+		resp, err := client.Post(url, "application/json", strings.NewReader("{}"))
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("POST %s: the webhook was sent", url)
+		} else if !strings.Contains(err.Error(), "internal address") {
+			t.Errorf("POST %s: got %v, want the internal address refused", url, err)
+		}
+	}
+	if n := received.Load(); n > 0 {
+		t.Errorf("the loopback receiver got %d webhooks", n)
+	}
+
+	o.webhookAllowedNetworks = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	resp, err := o.webhookClient().Post(receiver.URL, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("POST to an allowed network: %v", err)
+	}
+	resp.Body.Close()
+	if n := received.Load(); n != 1 {
+		t.Errorf("the allowed receiver got %d webhooks, want 1", n)
+	}
+}
+
+func TestSignPayload(t *testing.T) {
+	// echo -n '1700000000.{"id":"expr-1","status":"done"}' | openssl dgst -sha256 -hmac secret
+	const want = "f6c7fd7ea301ca72d2f35e51f711fa43ae15f18c0724b8f08b5e1d1c4b75fd55"
+	if got := SignPayload("secret", "1700000000", []byte(`{"id":"expr-1","status":"done"}`)); got != want {
+		t.Errorf("SignPayload = %s, want %s", got, want)
+	}
+}
@@ -9,8 +9,20 @@ var (
 	ErrMismatchedParentheses = errors.New("mismatched parentheses")
 	ErrInvalidNumber         = errors.New("invalid number")
 	ErrDivisionByZero        = errors.New("division by zero")
+	ErrUnboundVariable       = errors.New("unbound variable")
+	ErrDeadlineUnreachable   = errors.New("deadline cannot be met")
+	ErrInvalidCallbackURL    = errors.New("invalid callback URL")
+	ErrInvalidPriority       = errors.New("invalid priority")
 
 	ErrTaskNotFound      = errors.New("task not found")
 	ErrInvalidTaskResult = errors.New("invalid task result")
 	ErrNoTasksAvailable  = errors.New("no tasks available")
+	ErrFormulaNotFound   = errors.New("formula not found")
+	ErrLeaseExpired      = errors.New("task lease expired")
+	ErrTaskCancelled     = errors.New("task cancelled")
+
+	ErrExpressionNotFound = errors.New("expression not found")
+	ErrExpressionFinished = errors.New("expression already finished")
+	ErrAgentNotFound      = errors.New("agent not registered")
+	ErrInvalidCursor      = errors.New("invalid cursor")
 )
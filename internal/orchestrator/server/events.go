@@ -0,0 +1,118 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	core "distr-comp/internal/orchestrator/core"
+	errs "distr-comp/internal/orchestrator/errors"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// eventsKeepAlive is how often an idle event stream sends a comment so that
+// proxies don't close it.
+const eventsKeepAlive = 15 * time.Second
+
+// expressionEventsHandler streams the events of an expression as Server-Sent
+// Events: its current state first, then progress and status events until it
+// finishes.
+func expressionEventsHandler(o *core.Orchestrator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		snapshot, events, unsubscribe, err := o.SubscribeExpression(c.Param("id"))
+		if err != nil {
+			abortSubscription(c, err)
+			return
+		}
+		defer unsubscribe()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.SSEvent(snapshot.Type, snapshot)
+		c.Writer.Flush()
+		if events == nil {
+			return
+		}
+
+		ticker := time.NewTicker(eventsKeepAlive)
+		defer ticker.Stop()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return false
+				}
+				c.SSEvent(event.Type, event)
+				return true
+			case <-ticker.C:
+				io.WriteString(w, ": keep-alive\n\n")
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	}
+}
+
+// expressionWebSocketHandler is the WebSocket variant of
+// expressionEventsHandler. Every event is sent as a JSON text message.
+func expressionWebSocketHandler(o *core.Orchestrator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		snapshot, events, unsubscribe, err := o.SubscribeExpression(c.Param("id"))
+		if err != nil {
+			abortSubscription(c, err)
+			return
+		}
+		defer unsubscribe()
+
+		server := websocket.Server{Handshake: checkWebSocketOrigin}
+		server.Handler = func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			if err := websocket.JSON.Send(ws, snapshot); err != nil || events == nil {
+				return
+			}
+			// Clients only listen; reading detects when they go away.
+			go func() {
+				io.Copy(io.Discard, ws)
+				unsubscribe()
+			}()
+			for event := range events {
+				if err := websocket.JSON.Send(ws, event); err != nil {
+					return
+				}
+			}
+		}
+		server.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// checkWebSocketOrigin accepts clients without an Origin header, such as
+// scripts and services, and browsers only on pages served from the
+// orchestrator itself, so that other sites cannot read the events with the
+// visitor's access.
+func checkWebSocketOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin != nil && origin.Host != r.Host {
+		return fmt.Errorf("cross-origin WebSocket from %s", origin)
+	}
+	config.Origin = origin
+	return nil
+}
+
+func abortSubscription(c *gin.Context, err error) {
+	if errors.Is(err, errs.ErrExpressionNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "expression not found"})
+	} else {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to subscribe to expression"})
+	}
+}
@@ -0,0 +1,115 @@
+package orchestrator
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	core "distr-comp/internal/orchestrator/core"
+	types "distr-comp/internal/orchestrator/types"
+
+	"golang.org/x/net/websocket"
+)
+
+// readTextFrame reads one unmasked server text frame.
+func readTextFrame(t *testing.T, r *bufio.Reader) []byte {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatalf("read frame header: %v", err)
+	}
+	if header[0]&0x0f != websocket.TextFrame {
+		t.Fatalf("got opcode %d, want a text frame", header[0]&0x0f)
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			t.Fatalf("read frame length: %v", err)
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			t.Fatalf("read frame length: %v", err)
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("read frame payload: %v", err)
+	}
+	return payload
+}
+
+func TestExpressionWebSocketWithoutOrigin(t *testing.T) {
+	server, url, _, _ := startOrchestrator(t)
+	id, err := server.Orchestrator.AddExpression(context.Background(), "2+3", core.ExpressionOptions{})
+	if err != nil {
+		t.Fatalf("AddExpression: %v", err)
+	}
+
+	// The x/net client always sends an Origin header, so the handshake is
+	// written by hand.
+	host := strings.TrimPrefix(url, "http://")
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET /api/v1/expressions/"+id+"/ws HTTP/1.1\r\n"+
+		"Host: "+host+"\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	response, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("read handshake response: %v", err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want %d", response.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	var event types.ExpressionEvent
+	if err := json.Unmarshal(readTextFrame(t, r), &event); err != nil {
+		t.Fatalf("decode event: %v", err)
+	}
+	if event.Type != core.EventStatus || event.ExpressionID != id {
+		t.Errorf("got %s event for %s, want %s for %s", event.Type, event.ExpressionID, core.EventStatus, id)
+	}
+}
+
+func TestExpressionWebSocketOrigin(t *testing.T) {
+	server, url, _, _ := startOrchestrator(t)
+	id, err := server.Orchestrator.AddExpression(context.Background(), "2+3", core.ExpressionOptions{})
+	if err != nil {
+		t.Fatalf("AddExpression: %v", err)
+	}
+	location := "ws" + strings.TrimPrefix(url, "http") + "/api/v1/expressions/" + id + "/ws"
+
+	ws, err := websocket.Dial(location, "", url)
+	if err != nil {
+		t.Fatalf("same-origin dial: %v", err)
+	}
+	ws.Close()
+
+	if ws, err := websocket.Dial(location, "", "http://attacker.example"); err == nil {
+		ws.Close()
+		t.Error("a cross-origin WebSocket was accepted")
+	}
+}
@@ -0,0 +1,147 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	core "distr-comp/internal/orchestrator/core"
+	errs "distr-comp/internal/orchestrator/errors"
+	types "distr-comp/internal/orchestrator/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Formats of the expression graph, selected with ?format=.
+const (
+	graphFormatJSON    = "json"
+	graphFormatDOT     = "dot"
+	graphFormatMermaid = "mermaid"
+)
+
+// statusColors colours graph nodes by task status.
+var statusColors = map[string]string{
+	core.StatusPending:   "#e0e0e0",
+	core.StatusReady:     "#fff59d",
+	core.StatusProgress:  "#90caf9",
+	core.StatusDone:      "#a5d6a7",
+	core.StatusError:     "#ef9a9a",
+	core.StatusCancelled: "#bdbdbd",
+}
+
+// expressionGraphHandler returns the task DAG of an expression as JSON, or as
+// Graphviz DOT or Mermaid source with ?format=dot or ?format=mermaid. Edges
+// point from a task to the tasks that use its result.
+func expressionGraphHandler(o *core.Orchestrator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format := c.DefaultQuery("format", graphFormatJSON)
+		if format != graphFormatJSON && format != graphFormatDOT && format != graphFormatMermaid {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid format, expected json, dot or mermaid"})
+			return
+		}
+
+		graph, err := o.ExpressionGraph(c.Param("id"))
+		if errors.Is(err, errs.ErrExpressionNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "expression not found"})
+			return
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to get expression graph"})
+			return
+		}
+
+		switch format {
+		case graphFormatDOT:
+			c.String(http.StatusOK, renderDOT(graph))
+		case graphFormatMermaid:
+			c.String(http.StatusOK, renderMermaid(graph))
+		default:
+			c.JSON(http.StatusOK, gin.H{"graph": graph})
+		}
+	}
+}
+
+func renderDOT(graph *types.ExpressionGraph) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %q {\n", graph.Expression.ID)
+	b.WriteString("  rankdir=BT;\n")
+	b.WriteString("  node [shape=box, style=\"rounded,filled\", fontname=\"monospace\"];\n")
+	for _, task := range graph.Tasks {
+		label := strings.Join(nodeLabel(task), "\n")
+		fmt.Fprintf(&b, "  %q [label=%q, fillcolor=%q", task.ID, label, statusColors[task.Status])
+		if task.ID == graph.Root {
+			b.WriteString(", penwidth=2")
+		}
+		b.WriteString("];\n")
+	}
+	for _, task := range graph.Tasks {
+		for _, dep := range task.Dependencies {
+			fmt.Fprintf(&b, "  %q -> %q;\n", dep, task.ID)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func renderMermaid(graph *types.ExpressionGraph) string {
+	var b strings.Builder
+	b.WriteString("flowchart BT\n")
+	for _, task := range graph.Tasks {
+		lines := nodeLabel(task)
+		for i, line := range lines {
+			lines[i] = strings.ReplaceAll(line, `"`, "#quot;")
+		}
+		fmt.Fprintf(&b, "  %s[\"%s\"]\n", mermaidID(task.ID), strings.Join(lines, "<br/>"))
+	}
+	for _, task := range graph.Tasks {
+		for _, dep := range task.Dependencies {
+			fmt.Fprintf(&b, "  %s --> %s\n", mermaidID(dep), mermaidID(task.ID))
+		}
+	}
+	statuses := make([]string, 0, len(statusColors))
+	for status := range statusColors {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(&b, "  classDef %s fill:%s\n", mermaidID(status), statusColors[status])
+	}
+	for _, task := range graph.Tasks {
+		fmt.Fprintf(&b, "  class %s %s\n", mermaidID(task.ID), mermaidID(task.Status))
+	}
+	return b.String()
+}
+
+// nodeLabel describes a task in a few lines: the operation with its
+// arguments, the status with the result or error, and who ran it.
+func nodeLabel(task types.TaskNode) []string {
+	lines := []string{
+		task.ID,
+		fmt.Sprintf("%s(%s)", task.Operation, strings.Join(task.Args, ", ")),
+	}
+
+	switch {
+	case task.Result != nil:
+		lines = append(lines, fmt.Sprintf("%s = %s", task.Status, strconv.FormatFloat(*task.Result, 'g', -1, 64)))
+	case task.Error != nil:
+		lines = append(lines, fmt.Sprintf("%s: %s", task.Status, task.Error.Code))
+	default:
+		lines = append(lines, task.Status)
+	}
+
+	timing := fmt.Sprintf("%dms, critical path %dms", task.OperationTime, task.CriticalPath)
+	if task.AgentID != "" {
+		timing += ", " + task.AgentID
+	}
+	if task.Attempts > 1 {
+		timing += fmt.Sprintf(", %d attempts", task.Attempts)
+	}
+	return append(lines, timing)
+}
+
+// mermaidID turns a task ID or a status into a Mermaid identifier.
+func mermaidID(id string) string {
+	return strings.ReplaceAll(id, "-", "_")
+}
@@ -0,0 +1,254 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	pb "distr-comp/internal/agentpb"
+	logger "distr-comp/internal/logger"
+	core "distr-comp/internal/orchestrator/core"
+	errs "distr-comp/internal/orchestrator/errors"
+	types "distr-comp/internal/orchestrator/types"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpcTaskWait bounds each wait for ready tasks on a stream, so that the
+// stream notices evictions and shutdowns in reasonable time.
+const grpcTaskWait = 10 * time.Second
+
+// agentService serves the orchestrator–agent protocol over gRPC, next to the
+// HTTP endpoints used by agents that don't speak it.
+type agentService struct {
+	pb.UnimplementedAgentServiceServer
+	orchestrator *core.Orchestrator
+}
+
+// ServeGRPC serves the agent protocol on lis until it fails.
+func (s *Server) ServeGRPC(lis net.Listener) error {
+	return s.GRPC.Serve(lis)
+}
+
+func (s *Server) RunGRPC(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeGRPC(lis)
+}
+
+// Connect registers the agent from its hello message, then pushes tasks as
+// the agent grants credits while applying the outcomes and heartbeats it
+// streams back. The agent is removed and its tasks re-queued when the stream
+// ends.
+func (s *agentService) Connect(stream pb.AgentService_ConnectServer) error {
+	o := s.orchestrator
+
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	hello := msg.GetHello()
+	if hello == nil || hello.ComputingPower < 1 {
+		return status.Error(codes.InvalidArgument, "first message must be a hello with a positive computing power")
+	}
+
+	agent, err := o.RegisterAgent(hello.Hostname, int(hello.ComputingPower), hello.Version)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to register agent")
+	}
+	defer o.DisconnectAgent(agent.ID)
+
+	var sendMu sync.Mutex
+	send := func(msg *pb.OrchestratorMessage) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(msg)
+	}
+
+	welcome := &pb.Welcome{AgentId: agent.ID, HeartbeatIntervalMs: o.HeartbeatInterval().Milliseconds()}
+	if err := send(&pb.OrchestratorMessage{Body: &pb.OrchestratorMessage_Welcome{Welcome: welcome}}); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	credits := newAgentCredits(agent.ComputingPower)
+	received := make(chan error, 1)
+	go func() {
+		received <- s.receive(agent.ID, stream, send, credits)
+		cancel()
+	}()
+
+	for {
+		limit := min(credits.available(), maxTaskBatch)
+		if limit == 0 {
+			select {
+			case <-credits.changed:
+				continue
+			case <-ctx.Done():
+				return <-received
+			}
+		}
+
+		tasks, err := o.WaitNextTasks(ctx, agent.ID, limit, grpcTaskWait)
+		if errors.Is(err, errs.ErrNoTasksAvailable) {
+			if ctx.Err() != nil {
+				return <-received
+			}
+			continue
+		} else if errors.Is(err, errs.ErrAgentNotFound) {
+			return status.Error(codes.NotFound, "agent not registered")
+		} else if err != nil {
+			return status.Error(codes.Internal, "failed to get tasks")
+		}
+
+		for _, task := range tasks {
+			credits.dispatched(task.ID)
+			if err := send(&pb.OrchestratorMessage{Body: &pb.OrchestratorMessage_Task{Task: taskToPB(o.TaskResponse(task))}}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// receive handles the messages of the agent until the stream ends.
+func (s *agentService) receive(agentID string, stream pb.AgentService_ConnectServer, send func(*pb.OrchestratorMessage) error,
+	credits *agentCredits) error {
+	o := s.orchestrator
+
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch body := msg.Body.(type) {
+		case *pb.AgentMessage_Credit:
+			if body.Credit.Tasks < 1 || body.Credit.Tasks > maxTaskBatch {
+				return status.Errorf(codes.InvalidArgument, "credit must be between 1 and %d tasks", maxTaskBatch)
+			}
+			credits.add(int(body.Credit.Tasks))
+		case *pb.AgentMessage_Outcome:
+			outcome := outcomeFromPB(body.Outcome)
+			credits.finished(outcome.TaskID)
+			if err := o.ProcessTaskOutcomes([]core.TaskOutcome{outcome})[0]; err != nil {
+				logger.Warnf("Rejected the outcome of task %s from agent %s: %v", outcome.TaskID, agentID, err)
+			}
+		case *pb.AgentMessage_Heartbeat:
+			cancelled, err := o.Heartbeat(agentID, time.Now())
+			if err != nil {
+				return status.Error(codes.NotFound, "agent not registered")
+			}
+			// Agents drop cancelled tasks without reporting an outcome.
+			credits.finished(cancelled...)
+			if len(cancelled) > 0 {
+				if err := send(&pb.OrchestratorMessage{Body: &pb.OrchestratorMessage_Cancel{Cancel: &pb.Cancel{TaskIds: cancelled}}}); err != nil {
+					return err
+				}
+			}
+		default:
+			return status.Errorf(codes.InvalidArgument, "unexpected message %T", body)
+		}
+	}
+}
+
+// agentCredits tracks how many tasks may be pushed to an agent: the credits
+// it granted, as long as the tasks in flight leave room for them within its
+// computing power. Credits are not cut to that room on arrival, since an
+// agent grants the credit for a finished task before it sends the outcome.
+type agentCredits struct {
+	mu       sync.Mutex
+	power    int
+	credits  int
+	inFlight map[string]bool
+	// changed is signalled when more tasks may be pushed.
+	changed chan struct{}
+}
+
+func newAgentCredits(power int) *agentCredits {
+	return &agentCredits{
+		power:    power,
+		inFlight: make(map[string]bool),
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+// add grants n more credits. An agent never has more idle workers than its
+// computing power, so credits beyond it are dropped.
+func (c *agentCredits) add(n int) {
+	c.mu.Lock()
+	c.credits = min(c.credits+n, c.power)
+	c.mu.Unlock()
+	c.notify()
+}
+
+// available returns how many tasks may be pushed now.
+func (c *agentCredits) available() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return max(min(c.credits, c.power-len(c.inFlight)), 0)
+}
+
+// dispatched spends a credit on the task.
+func (c *agentCredits) dispatched(taskID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.credits--
+	c.inFlight[taskID] = true
+}
+
+// finished frees the room taken by the tasks, if they were in flight.
+func (c *agentCredits) finished(taskIDs ...string) {
+	c.mu.Lock()
+	for _, id := range taskIDs {
+		delete(c.inFlight, id)
+	}
+	c.mu.Unlock()
+	c.notify()
+}
+
+func (c *agentCredits) notify() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+func taskToPB(task types.TaskResponse) *pb.Task {
+	return &pb.Task{
+		Id:            task.ID,
+		LeaseId:       task.LeaseID,
+		Args:          task.Args,
+		Operation:     task.Operation,
+		OperationTime: int32(task.OperationTime),
+		TraceParent:   task.TraceParent,
+	}
+}
+
+func outcomeFromPB(msg *pb.TaskOutcome) core.TaskOutcome {
+	outcome := core.TaskOutcome{TaskID: msg.Id, LeaseID: msg.LeaseId}
+	switch body := msg.Outcome.(type) {
+	case *pb.TaskOutcome_Result:
+		result := body.Result
+		outcome.Result = &result
+	case *pb.TaskOutcome_Error:
+		outcome.Error = &types.ErrorDetail{Code: body.Error.Code, Message: body.Error.Message}
+	}
+	return outcome
+}
+
+func newGRPCServer(o *core.Orchestrator) *grpc.Server {
+	server := grpc.NewServer()
+	pb.RegisterAgentServiceServer(server, &agentService{orchestrator: o})
+	return server
+}
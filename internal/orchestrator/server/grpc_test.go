@@ -0,0 +1,143 @@
+package orchestrator
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	agent "distr-comp/internal/agent/client"
+	core "distr-comp/internal/orchestrator/core"
+	store "distr-comp/internal/orchestrator/store"
+	types "distr-comp/internal/orchestrator/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startOrchestrator serves a fresh orchestrator over HTTP and gRPC and
+// returns it with both addresses and a counter of agent requests received
+// over HTTP.
+func startOrchestrator(t *testing.T) (*Server, string, string, *atomic.Int32) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	operationTimes := make(map[string]time.Duration)
+	for _, op := range []string{"+", "-", "*", "/", "^", "%", "//", "sqrt", "sin", "cos", "log", "abs", "min", "max", "pow"} {
+		operationTimes[op] = 10
+	}
+	server, err := NewServer(core.Config{OperationTimes: operationTimes}, store.NewNopStore())
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	var agentRequests atomic.Int32
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/internal/") {
+			agentRequests.Add(1)
+		}
+		server.Engine.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		// Long-polling agents would hold up Close until their wait elapses.
+		httpServer.CloseClientConnections()
+		httpServer.Close()
+	})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go server.ServeGRPC(lis)
+	t.Cleanup(server.GRPC.Stop)
+
+	return server, httpServer.URL, lis.Addr().String(), &agentRequests
+}
+
+// waitExpression waits for the expression to leave the pending status.
+func waitExpression(t *testing.T, o *core.Orchestrator, id string) types.ExpressionResponse {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		expr, _, err := o.GetExpression(id)
+		if err != nil {
+			t.Fatalf("GetExpression(%s): %v", id, err)
+		}
+		if expr.Status != core.StatusPending {
+			return expr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expression %s still pending", id)
+	return types.ExpressionResponse{}
+}
+
+func TestAgentTransports(t *testing.T) {
+	for _, transport := range []string{agent.TransportHTTP, agent.TransportGRPC} {
+		t.Run(transport, func(t *testing.T) {
+			server, url, grpcAddr, agentRequests := startOrchestrator(t)
+			o := server.Orchestrator
+
+			go agent.Start(agent.Config{
+				ComputingPower:  2,
+				OrchestratorURL: url,
+				Transport:       transport,
+				GRPCAddr:        grpcAddr,
+			})
+
+			sumID, err := o.AddExpression(context.Background(), "(2+3)*4-sqrt(16)", core.ExpressionOptions{})
+			if err != nil {
+				t.Fatalf("AddExpression: %v", err)
+			}
+			divID, err := o.AddExpression(context.Background(), "1/0", core.ExpressionOptions{})
+			if err != nil {
+				t.Fatalf("AddExpression: %v", err)
+			}
+
+			sum := waitExpression(t, o, sumID)
+			if sum.Status != core.StatusDone || sum.Result == nil || *sum.Result != 16 {
+				t.Errorf("(2+3)*4-sqrt(16): got status %s, result %v, want done with 16", sum.Status, sum.Result)
+			}
+
+			div := waitExpression(t, o, divID)
+			if div.Status != core.StatusError || div.Error == nil || div.Error.Code != agent.ErrorCodeDivisionByZero {
+				t.Errorf("1/0: got status %s, error %+v, want error with code %s", div.Status, div.Error, agent.ErrorCodeDivisionByZero)
+			}
+
+			switch n := agentRequests.Load(); {
+			case transport == agent.TransportGRPC && n > 0:
+				t.Errorf("the gRPC agent sent %d requests over HTTP", n)
+			case transport == agent.TransportHTTP && n == 0:
+				t.Error("the HTTP agent sent no requests over HTTP")
+			}
+		})
+	}
+}
+
+func TestAgentCreditsCappedByComputingPower(t *testing.T) {
+	credits := newAgentCredits(2)
+	credits.add(maxTaskBatch)
+	if n := credits.available(); n != 2 {
+		t.Fatalf("after a huge credit: %d tasks available, want 2", n)
+	}
+
+	credits.dispatched("task-1")
+	credits.dispatched("task-2")
+	// The agent grants the credit for task-1 before its outcome arrives.
+	credits.add(1)
+	if n := credits.available(); n != 0 {
+		t.Fatalf("with both workers busy: %d tasks available, want 0", n)
+	}
+
+	credits.finished("task-1")
+	if n := credits.available(); n != 1 {
+		t.Fatalf("after an outcome: %d tasks available, want 1", n)
+	}
+	credits.finished("task-2", "task-3")
+	if n := credits.available(); n != 1 {
+		t.Errorf("after a cancellation: %d tasks available, want 1 credit", n)
+	}
+}
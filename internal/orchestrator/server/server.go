@@ -2,74 +2,103 @@ package orchestrator
 
 import (
 	"errors"
-	"math"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	logger "distr-comp/internal/logger"
 	core "distr-comp/internal/orchestrator/core"
 	errs "distr-comp/internal/orchestrator/errors"
+	store "distr-comp/internal/orchestrator/store"
 	types "distr-comp/internal/orchestrator/types"
-	utils "distr-comp/internal/orchestrator/utils"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
+var tracer = otel.Tracer("distr-comp/internal/orchestrator/server")
+
 type Server struct {
 	Engine       *gin.Engine
+	GRPC         *grpc.Server
 	Orchestrator *core.Orchestrator
 }
 
-func NewServer(timeAddition, timeSubtraction, timeMultiplication, timeDivision time.Duration) *Server {
+func NewServer(cfg core.Config, st store.Store) (*Server, error) {
+	orchestrator, err := core.NewOrchestrator(cfg, st)
+	if err != nil {
+		return nil, err
+	}
+
 	engine := gin.Default()
 	server := &Server{
 		Engine:       engine,
-		Orchestrator: core.NewOrchestrator(timeAddition, timeSubtraction, timeMultiplication, timeDivision),
+		GRPC:         newGRPCServer(orchestrator),
+		Orchestrator: orchestrator,
 	}
 
 	engine.POST("/api/v1/calculate", calculateHandler(server.Orchestrator))
 	engine.GET("/api/v1/expressions", listExpressionsHandler(server.Orchestrator))
 	engine.GET("/api/v1/expressions/:id", getExpressionHandler(server.Orchestrator))
+	engine.GET("/api/v1/expressions/:id/graph", expressionGraphHandler(server.Orchestrator))
+	engine.GET("/api/v1/expressions/:id/events", expressionEventsHandler(server.Orchestrator))
+	engine.GET("/api/v1/expressions/:id/ws", expressionWebSocketHandler(server.Orchestrator))
+	engine.DELETE("/api/v1/expressions/:id", cancelExpressionHandler(server.Orchestrator))
+	engine.POST("/api/v1/expressions/:id/cancel", cancelExpressionHandler(server.Orchestrator))
+	engine.POST("/api/v1/formulas", createFormulaHandler(server.Orchestrator))
+	engine.GET("/api/v1/formulas/:id", getFormulaHandler(server.Orchestrator))
+	engine.POST("/api/v1/formulas/:id/evaluate", evaluateFormulaHandler(server.Orchestrator))
+	engine.GET("/api/v1/agents", listAgentsHandler(server.Orchestrator))
 	engine.GET("/internal/task", getTaskHandler(server.Orchestrator))
+	engine.POST("/internal/agents/register", registerAgentHandler(server.Orchestrator))
+	engine.POST("/internal/agents/:id/heartbeat", heartbeatHandler(server.Orchestrator))
 	engine.POST("/internal/task", submitTaskResultHandler(server.Orchestrator))
+	engine.GET("/internal/tasks", getTasksHandler(server.Orchestrator))
+	engine.POST("/internal/tasks/results", submitTaskResultsHandler(server.Orchestrator))
+	engine.GET("/metrics", metricsHandler(server.Orchestrator))
 
-	return server
+	return server, nil
 }
 
-func (s *Server) Run(port string) error {
-	return s.Engine.Run(port)
+// metricsHandler exposes the orchestrator metrics, along with the Go runtime
+// and process ones, in the Prometheus text format.
+func metricsHandler(o *core.Orchestrator) gin.HandlerFunc {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		o.MetricsCollector(),
+	)
+	return gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
 }
 
-func resolveTask(o *core.Orchestrator, task *types.Task) types.TaskResponse {
-	o.Mu.RLock()
-	defer o.Mu.RUnlock()
-
-	resolveArg := func(arg string) float64 {
-		if utils.IsNumber(arg) {
-			val, _ := strconv.ParseFloat(arg, 64)
-			return val
-		}
-		if t, exists := o.Tasks[arg]; exists && t.Result != nil {
-			return *t.Result
-		}
-		return math.NaN()
-	}
-
-	return types.TaskResponse{
-		ID:            task.ID,
-		Operation:     task.Operation,
-		Arg1:          resolveArg(task.Arg1),
-		Arg2:          resolveArg(task.Arg2),
-		OperationTime: int(o.OperationTimes[task.Operation]),
-	}
+func (s *Server) Run(port string) error {
+	return s.Engine.Run(port)
 }
 
+// calculateHandler starts the trace of the expression: its tasks are traced
+// as children of the request span.
 func calculateHandler(o *core.Orchestrator) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		ctx, span := tracer.Start(c.Request.Context(), "calculate")
+		defer span.End()
+
 		var req struct {
-			Expression string `json:"expression" binding:"required"`
+			Expression  string             `json:"expression" binding:"required"`
+			Variables   map[string]float64 `json:"variables"`
+			StrictOrder bool               `json:"strict_order"`
+			Priority    int                `json:"priority"`
+			Deadline    *time.Time         `json:"deadline"`
+			CallbackURL string             `json:"callback_url"`
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -85,37 +114,116 @@ func calculateHandler(o *core.Orchestrator) gin.HandlerFunc {
 			return
 		}
 
-		exprID, err := o.AddExpression(req.Expression)
+		exprID, err := o.AddExpression(ctx, req.Expression, core.ExpressionOptions{
+			Variables:   req.Variables,
+			StrictOrder: req.StrictOrder,
+			Priority:    req.Priority,
+			Deadline:    req.Deadline,
+			CallbackURL: req.CallbackURL,
+		})
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to process expression"})
-			logger.Error("failed to process expression", zap.Error(err))
+			span.SetStatus(codes.Error, err.Error())
+			abortAddExpressionError(c, err)
 			return
 		}
+		span.SetAttributes(attribute.String("expression.id", exprID))
 
 		c.JSON(http.StatusCreated, gin.H{"id": exprID})
 	}
 }
 
+// abortAddExpressionError answers a request that failed to start an
+// expression, directly or from a formula, with the status matching err.
+func abortAddExpressionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errs.ErrFormulaNotFound):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "formula not found"})
+	case errors.Is(err, errs.ErrDeadlineUnreachable):
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "code": core.ErrorCodeDeadlineExceeded})
+	case errors.Is(err, errs.ErrInvalidCallbackURL), errors.Is(err, errs.ErrInvalidPriority):
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, errs.ErrInvalidExpression):
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		logger.Error("invalid expression", zap.Error(err))
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to process expression"})
+		logger.Error("failed to process expression", zap.Error(err))
+	}
+}
+
+// listExpressionsHandler returns a page of expressions, newest first unless
+// ?order=asc. The page is narrowed with ?status=done,error, ?created_after=
+// and ?created_before= (RFC 3339), and continued with the next_cursor of the
+// previous response passed as ?cursor=.
 func listExpressionsHandler(o *core.Orchestrator) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		expressions, err := o.GetAllExpressions()
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to get all expressions"})
+		query, ok := parseExpressionQuery(c)
+		if !ok {
+			return
+		}
+
+		response, next, err := o.ListExpressions(query)
+		if errors.Is(err, errs.ErrInvalidCursor) {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid cursor"})
+			return
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to list expressions"})
 			return
 		}
 
-		response := make([]types.ExpressionResponse, 0, len(expressions))
+		c.JSON(http.StatusOK, gin.H{"expressions": response, "next_cursor": next})
+	}
+}
 
-		for _, expr := range expressions {
-			response = append(response, types.ExpressionResponse{
-				ID:     expr.ID,
-				Status: expr.Status,
-				Result: expr.Result,
-			})
+// parseExpressionQuery reads the parameters of listExpressionsHandler. On an
+// invalid value it aborts the request and returns false.
+func parseExpressionQuery(c *gin.Context) (core.ExpressionQuery, bool) {
+	query := core.ExpressionQuery{Cursor: c.Query("cursor"), Descending: true}
+	invalid := func(param string) (core.ExpressionQuery, bool) {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid " + param})
+		return query, false
+	}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return invalid("limit")
 		}
+		query.Limit = limit
+	}
 
-		c.JSON(http.StatusOK, gin.H{"expressions": response})
+	switch c.DefaultQuery("order", "desc") {
+	case "desc":
+	case "asc":
+		query.Descending = false
+	default:
+		return invalid("order")
 	}
+
+	for _, value := range c.QueryArray("status") {
+		for _, status := range strings.Split(value, ",") {
+			switch status {
+			case core.StatusPending, core.StatusDone, core.StatusError, core.StatusCancelled:
+				query.Statuses = append(query.Statuses, status)
+			default:
+				return invalid("status")
+			}
+		}
+	}
+
+	for param, bound := range map[string]**time.Time{
+		"created_after":  &query.CreatedAfter,
+		"created_before": &query.CreatedBefore,
+	} {
+		if value := c.Query(param); value != "" {
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return invalid(param)
+			}
+			*bound = &t
+		}
+	}
+	return query, true
 }
 
 func getExpressionHandler(o *core.Orchestrator) gin.HandlerFunc {
@@ -131,38 +239,269 @@ func getExpressionHandler(o *core.Orchestrator) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{
-			"expression": types.ExpressionResponse{
-				ID:     expr.ID,
-				Status: expr.Status,
-				Result: expr.Result,
-			},
+		c.JSON(http.StatusOK, gin.H{"expression": expr})
+	}
+}
+
+func cancelExpressionHandler(o *core.Orchestrator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		expr, err := o.CancelExpression(c.Param("id"))
+		if err != nil {
+			if errors.Is(err, errs.ErrExpressionNotFound) {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "expression not found"})
+			} else if errors.Is(err, errs.ErrExpressionFinished) {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "expression already finished"})
+			} else {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel expression"})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"expression": expr})
+	}
+}
+
+func createFormulaHandler(o *core.Orchestrator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Expression string `json:"expression" binding:"required"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid request body"})
+			logger.Error("invalid request body", zap.Error(err))
+			return
+		}
+
+		if err := core.ValidateExpression(req.Expression); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			logger.Error("invalid expression", zap.Error(err))
+			return
+		}
+
+		formula, err := o.AddFormula(c.Request.Context(), req.Expression)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			logger.Error("invalid formula", zap.Error(err))
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"formula": formula})
+	}
+}
+
+func getFormulaHandler(o *core.Orchestrator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		formula, exists := o.GetFormula(c.Param("id"))
+		if !exists {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "formula not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"formula": formula})
+	}
+}
+
+func evaluateFormulaHandler(o *core.Orchestrator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, span := tracer.Start(c.Request.Context(), "evaluate formula")
+		defer span.End()
+
+		var req struct {
+			Variables   map[string]float64 `json:"variables"`
+			StrictOrder bool               `json:"strict_order"`
+			Priority    int                `json:"priority"`
+			Deadline    *time.Time         `json:"deadline"`
+			CallbackURL string             `json:"callback_url"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid request body"})
+			logger.Error("invalid request body", zap.Error(err))
+			return
+		}
+
+		exprID, err := o.EvaluateFormula(ctx, c.Param("id"), core.ExpressionOptions{
+			Variables:   req.Variables,
+			StrictOrder: req.StrictOrder,
+			Priority:    req.Priority,
+			Deadline:    req.Deadline,
+			CallbackURL: req.CallbackURL,
 		})
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			abortAddExpressionError(c, err)
+			return
+		}
+		span.SetAttributes(attribute.String("expression.id", exprID))
+
+		c.JSON(http.StatusCreated, gin.H{"id": exprID})
 	}
 }
 
+// maxTaskWait caps the wait parameter of long-polling agents.
+const maxTaskWait = time.Minute
+
+// getTaskHandler hands out the next task. With ?wait=30s it holds the request
+// until a task is ready or the wait elapses. Both the task and the "no tasks"
+// responses list the cancelled tasks agents should stop working on.
 func getTaskHandler(o *core.Orchestrator) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		task, err := o.GetNextTask()
+		wait, ok := parseWait(c)
+		if !ok {
+			return
+		}
+
+		agentID := c.Query("agent_id")
+		task, err := o.WaitNextTask(c.Request.Context(), agentID, wait)
+		cancelled := o.CancelledTaskIDs(agentID, time.Now())
 		if err != nil {
 			if errors.Is(err, errs.ErrNoTasksAvailable) {
-				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "no tasks available"})
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "no tasks available", "cancelled": cancelled})
+			} else if errors.Is(err, errs.ErrAgentNotFound) {
+				c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": "agent not registered"})
 			} else {
 				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
 			}
 			return
 		}
 
-		resolvedTask := resolveTask(o, task)
-		c.JSON(http.StatusOK, gin.H{"task": resolvedTask})
+		c.JSON(http.StatusOK, gin.H{"task": o.TaskResponse(task), "cancelled": cancelled})
+	}
+}
+
+// getTasksHandler hands out up to ?max=N tasks at once, waiting like
+// getTaskHandler for the first one. An empty list means the wait elapsed.
+func getTasksHandler(o *core.Orchestrator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		wait, ok := parseWait(c)
+		if !ok {
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("max", "1"))
+		if err != nil || limit < 1 {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid max"})
+			return
+		}
+		limit = min(limit, maxTaskBatch)
+
+		agentID := c.Query("agent_id")
+		tasks, err := o.WaitNextTasks(c.Request.Context(), agentID, limit, wait)
+		cancelled := o.CancelledTaskIDs(agentID, time.Now())
+		if err != nil && !errors.Is(err, errs.ErrNoTasksAvailable) {
+			if errors.Is(err, errs.ErrAgentNotFound) {
+				c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": "agent not registered"})
+			} else {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			}
+			return
+		}
+
+		response := make([]types.TaskResponse, 0, len(tasks))
+		for _, task := range tasks {
+			response = append(response, o.TaskResponse(task))
+		}
+		c.JSON(http.StatusOK, gin.H{"tasks": response, "cancelled": cancelled})
+	}
+}
+
+// maxTaskBatch caps the max parameter of batch task requests.
+const maxTaskBatch = 1000
+
+// parseWait reads the optional ?wait= duration of task requests, capped at
+// maxTaskWait. On an invalid value it aborts the request and returns false.
+func parseWait(c *gin.Context) (time.Duration, bool) {
+	value := c.Query("wait")
+	if value == "" {
+		return 0, true
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait < 0 {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid wait duration"})
+		return 0, false
+	}
+	return min(wait, maxTaskWait), true
+}
+
+// taskOutcomeRequest is the result or the failure an agent reports for a
+// task.
+type taskOutcomeRequest struct {
+	ID      string             `json:"id" binding:"required"`
+	LeaseID string             `json:"lease_id" binding:"required"`
+	Result  *float64           `json:"result"`
+	Error   *types.ErrorDetail `json:"error"`
+}
+
+// validate returns a description of what is wrong with the request, or an
+// empty string.
+func (r *taskOutcomeRequest) validate() string {
+	if r.ID == "" || r.LeaseID == "" {
+		return "id and lease_id are required"
+	}
+	if (r.Result == nil) == (r.Error == nil) {
+		return "exactly one of result and error must be set"
+	}
+	if r.Error != nil && r.Error.Code == "" {
+		return "error code is required"
+	}
+	return ""
+}
+
+// taskOutcomeStatus maps the error of a task outcome to its HTTP status and
+// message.
+func taskOutcomeStatus(err error) (int, string) {
+	switch {
+	case err == nil:
+		return http.StatusOK, ""
+	case errors.Is(err, errs.ErrTaskNotFound):
+		return http.StatusNotFound, "task not found"
+	case errors.Is(err, errs.ErrLeaseExpired):
+		return http.StatusConflict, "task lease expired"
+	case errors.Is(err, errs.ErrTaskCancelled):
+		return http.StatusConflict, "task cancelled"
+	case errors.Is(err, errs.ErrInvalidTaskResult):
+		return http.StatusUnprocessableEntity, "invalid task result"
+	default:
+		return http.StatusInternalServerError, "internal error"
 	}
 }
 
 func submitTaskResultHandler(o *core.Orchestrator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req taskOutcomeRequest
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid request body"})
+			return
+		}
+		if problem := req.validate(); problem != "" {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": problem})
+			return
+		}
+
+		var err error
+		if req.Error != nil {
+			err = o.ProcessTaskFailure(req.ID, req.LeaseID, req.Error.Code, req.Error.Message)
+		} else {
+			err = o.ProcessTaskResult(req.ID, req.LeaseID, *req.Result)
+		}
+
+		if status, message := taskOutcomeStatus(err); err != nil {
+			c.AbortWithStatusJSON(status, gin.H{"error": message})
+			return
+		}
+
+		c.Status(http.StatusOK)
+	}
+}
+
+// submitTaskResultsHandler accepts many task outcomes in one request. The
+// response holds a status for each of them, in order; invalid entries are
+// rejected without affecting the others.
+func submitTaskResultsHandler(o *core.Orchestrator) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
-			ID     string  `json:"id" binding:"required"`
-			Result float64 `json:"result" binding:"required"`
+			Results []taskOutcomeRequest `json:"results" binding:"required"`
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -170,17 +509,112 @@ func submitTaskResultHandler(o *core.Orchestrator) gin.HandlerFunc {
 			return
 		}
 
-		if err := o.ProcessTaskResult(req.ID, req.Result); err != nil {
-			if errors.Is(err, errs.ErrTaskNotFound) {
-				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "task not found"})
-			} else if errors.Is(err, errs.ErrInvalidTaskResult) {
-				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid task result"})
+		type itemResponse struct {
+			ID     string `json:"id"`
+			Status int    `json:"status"`
+			Error  string `json:"error,omitempty"`
+		}
+		response := make([]itemResponse, len(req.Results))
+
+		var outcomes []core.TaskOutcome
+		var positions []int
+		for i, result := range req.Results {
+			response[i] = itemResponse{ID: result.ID, Status: http.StatusOK}
+			if problem := result.validate(); problem != "" {
+				response[i].Status = http.StatusUnprocessableEntity
+				response[i].Error = problem
+				continue
+			}
+			outcomes = append(outcomes, core.TaskOutcome{
+				TaskID:  result.ID,
+				LeaseID: result.LeaseID,
+				Result:  result.Result,
+				Error:   result.Error,
+			})
+			positions = append(positions, i)
+		}
+
+		for i, err := range o.ProcessTaskOutcomes(outcomes) {
+			response[positions[i]].Status, response[positions[i]].Error = taskOutcomeStatus(err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"results": response})
+	}
+}
+
+func registerAgentHandler(o *core.Orchestrator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Hostname       string `json:"hostname"`
+			ComputingPower int    `json:"computing_power" binding:"required,min=1"`
+			Version        string `json:"version"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid request body"})
+			logger.Error("invalid request body", zap.Error(err))
+			return
+		}
+
+		agent, err := o.RegisterAgent(req.Hostname, req.ComputingPower, req.Version)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to register agent"})
+			logger.Error("failed to register agent", zap.Error(err))
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"agent":                 agent,
+			"heartbeat_interval_ms": o.HeartbeatInterval().Milliseconds(),
+		})
+	}
+}
+
+// heartbeatHandler keeps an agent alive and tells it which of its tasks were
+// cancelled. Unknown or evicted agents get 410 and must register again.
+func heartbeatHandler(o *core.Orchestrator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cancelled, err := o.Heartbeat(c.Param("id"), time.Now())
+		if err != nil {
+			if errors.Is(err, errs.ErrAgentNotFound) {
+				c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": "agent not registered"})
 			} else {
 				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
 			}
 			return
 		}
 
-		c.Status(http.StatusOK)
+		c.JSON(http.StatusOK, gin.H{"cancelled": cancelled})
 	}
 }
+
+func listAgentsHandler(o *core.Orchestrator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"agents": agentResponses(o)})
+	}
+}
+
+func agentResponses(o *core.Orchestrator) []types.AgentResponse {
+	o.Mu.RLock()
+	defer o.Mu.RUnlock()
+
+	response := make([]types.AgentResponse, 0, len(o.Agents))
+	for _, agent := range o.Agents {
+		tasks := o.AgentTasks(agent.ID)
+		sort.Strings(tasks)
+		response = append(response, types.AgentResponse{
+			ID:             agent.ID,
+			Hostname:       agent.Hostname,
+			ComputingPower: agent.ComputingPower,
+			Version:        agent.Version,
+			RegisteredAt:   agent.RegisteredAt,
+			LastSeen:       agent.LastSeen,
+			Tasks:          tasks,
+		})
+	}
+
+	sort.Slice(response, func(i, j int) bool {
+		return response[i].RegisteredAt.Before(response[j].RegisteredAt)
+	})
+	return response
+}
@@ -0,0 +1,285 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	types "distr-comp/internal/orchestrator/types"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	expressionsBucket = []byte("expressions")
+	tasksBucket       = []byte("tasks")
+	formulasBucket    = []byte("formulas")
+	deliveriesBucket  = []byte("deliveries")
+	metaBucket        = []byte("meta")
+
+	countersKey = []byte("counters")
+)
+
+// storedExpression keeps the task order of an expression, which is not part
+// of its JSON representation.
+type storedExpression struct {
+	*types.Expression
+	TaskIDs []string `json:"task_ids"`
+}
+
+// storedTask keeps the unresolved dependencies of a task, which are hidden
+// from the API.
+type storedTask struct {
+	*types.Task
+	Dependencies []string `json:"dependencies"`
+}
+
+// BoltStore is a Store backed by a single bbolt database file. Save only
+// encodes the records; a background writer commits them in order, merging
+// the batches that piled up during the previous commit into one
+// transaction, so callers never wait for the disk.
+type BoltStore struct {
+	db *bolt.DB
+
+	mu      sync.Mutex
+	pending []write
+	// err is the last failed commit, reported by the next Save or Close.
+	err error
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// write puts the encoded value under the key, or deletes the key when value
+// is nil.
+type write struct {
+	bucket []byte
+	key    string
+	value  []byte
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{expressionsBucket, tasksBucket, formulasBucket, deliveriesBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init store %s: %w", path, err)
+	}
+
+	s := &BoltStore{
+		db:   db,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *BoltStore) Save(records Records) error {
+	writes, err := encode(records)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.pending = append(s.pending, writes...)
+	err, s.err = s.err, nil
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// encode marshals the records while the caller still guarantees they do not
+// change.
+func encode(records Records) ([]write, error) {
+	var writes []write
+	put := func(bucket []byte, key string, value interface{}) error {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("encode %s: %w", key, err)
+		}
+		writes = append(writes, write{bucket: bucket, key: key, value: data})
+		return nil
+	}
+
+	for _, expr := range records.Expressions {
+		taskIDs := make([]string, 0, len(expr.Tasks))
+		for _, task := range expr.Tasks {
+			taskIDs = append(taskIDs, task.ID)
+		}
+		if err := put(expressionsBucket, expr.ID, storedExpression{Expression: expr, TaskIDs: taskIDs}); err != nil {
+			return nil, err
+		}
+	}
+	for _, task := range records.Tasks {
+		if err := put(tasksBucket, task.ID, storedTask{Task: task, Dependencies: task.Dependencies}); err != nil {
+			return nil, err
+		}
+	}
+	for _, formula := range records.Formulas {
+		if err := put(formulasBucket, formula.ID, formula); err != nil {
+			return nil, err
+		}
+	}
+	for _, delivery := range records.Deliveries {
+		if err := put(deliveriesBucket, delivery.ID, delivery); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range records.DeletedDeliveries {
+		writes = append(writes, write{bucket: deliveriesBucket, key: id})
+	}
+	if records.Counters != nil {
+		if err := put(metaBucket, string(countersKey), records.Counters); err != nil {
+			return nil, err
+		}
+	}
+	return writes, nil
+}
+
+func (s *BoltStore) run() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.wake:
+			s.commit()
+		case <-s.stop:
+			s.commit()
+			return
+		}
+	}
+}
+
+// commit writes everything saved so far in one transaction.
+func (s *BoltStore) commit() {
+	s.mu.Lock()
+	writes := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(writes) == 0 {
+		return
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, w := range writes {
+			bucket := tx.Bucket(w.bucket)
+			if w.value == nil {
+				if err := bucket.Delete([]byte(w.key)); err != nil {
+					return err
+				}
+			} else if err := bucket.Put([]byte(w.key), w.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.mu.Lock()
+		s.err = fmt.Errorf("commit %d writes: %w", len(writes), err)
+		s.mu.Unlock()
+	}
+}
+
+func (s *BoltStore) Load() (Records, error) {
+	var records Records
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		tasksByID := make(map[string]*types.Task)
+		err := tx.Bucket(tasksBucket).ForEach(func(k, v []byte) error {
+			var stored storedTask
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return fmt.Errorf("decode task %s: %w", k, err)
+			}
+			stored.Task.Dependencies = stored.Dependencies
+			tasksByID[stored.Task.ID] = stored.Task
+			records.Tasks = append(records.Tasks, stored.Task)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(expressionsBucket).ForEach(func(k, v []byte) error {
+			var stored storedExpression
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return fmt.Errorf("decode expression %s: %w", k, err)
+			}
+			for _, taskID := range stored.TaskIDs {
+				task, exists := tasksByID[taskID]
+				if !exists {
+					return fmt.Errorf("expression %s references unknown task %s", k, taskID)
+				}
+				stored.Expression.Tasks = append(stored.Expression.Tasks, task)
+			}
+			records.Expressions = append(records.Expressions, stored.Expression)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(formulasBucket).ForEach(func(k, v []byte) error {
+			var formula types.Formula
+			if err := json.Unmarshal(v, &formula); err != nil {
+				return fmt.Errorf("decode formula %s: %w", k, err)
+			}
+			records.Formulas = append(records.Formulas, &formula)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(deliveriesBucket).ForEach(func(k, v []byte) error {
+			var delivery types.Delivery
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return fmt.Errorf("decode delivery %s: %w", k, err)
+			}
+			records.Deliveries = append(records.Deliveries, &delivery)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if data := tx.Bucket(metaBucket).Get(countersKey); data != nil {
+			records.Counters = &Counters{}
+			if err := json.Unmarshal(data, records.Counters); err != nil {
+				return fmt.Errorf("decode counters: %w", err)
+			}
+		}
+		return nil
+	})
+
+	return records, err
+}
+
+// Close commits the pending writes and closes the database.
+func (s *BoltStore) Close() error {
+	close(s.stop)
+	<-s.done
+
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+	return errors.Join(err, s.db.Close())
+}
@@ -0,0 +1,61 @@
+package orchestrator
+
+import (
+	types "distr-comp/internal/orchestrator/types"
+)
+
+// Store persists orchestrator state so that submitted expressions survive a
+// restart. Implementations are never called concurrently.
+type Store interface {
+	// Save writes every record in the batch atomically. Records with an ID
+	// that already exists are overwritten. It is called while the
+	// orchestrator holds its lock: it must be done with the records when it
+	// returns, as they keep changing, but should not wait for the disk.
+	// Batches are applied in the order they were saved.
+	Save(records Records) error
+	// Load returns everything that has been saved so far.
+	Load() (Records, error)
+	Close() error
+}
+
+// Records is a set of objects written to or read from a Store. On Save only
+// the changed objects are set; Counters is written only when non-nil.
+type Records struct {
+	Expressions []*types.Expression
+	Tasks       []*types.Task
+	Formulas    []*types.Formula
+	Deliveries  []*types.Delivery
+	// DeletedDeliveries lists the IDs of deliveries removed from the outbox.
+	// It is only used on Save.
+	DeletedDeliveries []string
+	Counters          *Counters
+}
+
+// Counters holds the ID sequences of the orchestrator, so that IDs are not
+// reused after a restart.
+type Counters struct {
+	Expressions int `json:"expressions"`
+	Tasks       int `json:"tasks"`
+	Leases      int `json:"leases"`
+	Formulas    int `json:"formulas"`
+	Deliveries  int `json:"deliveries"`
+}
+
+// NopStore keeps nothing; it is used when persistence is disabled.
+type NopStore struct{}
+
+func NewNopStore() *NopStore {
+	return &NopStore{}
+}
+
+func (s *NopStore) Save(records Records) error {
+	return nil
+}
+
+func (s *NopStore) Load() (Records, error) {
+	return Records{}, nil
+}
+
+func (s *NopStore) Close() error {
+	return nil
+}
@@ -1,47 +1,206 @@
 package orchestrator
 
 import (
+	"encoding/json"
 	"sync"
+	"time"
 )
 
 type Task struct {
-	ID            string   `json:"id"`
-	ExpressionID  string   `json:"expression_id"`
-	Arg1          string   `json:"arg1"`
-	Arg2          string   `json:"arg2"`
-	Operation     string   `json:"operation"`
-	OperationTime int      `json:"operation_time"`
-	Dependencies  []string `json:"-"`
-	Status        string   `json:"status"`
-	Result        *float64 `json:"result"`
+	ID string `json:"id"`
+	// Seq is the number in the ID; the scheduler compares it instead of
+	// the ID.
+	Seq           int          `json:"-"`
+	ExpressionID  string       `json:"expression_id"`
+	Args          []string     `json:"args"`
+	Operation     string       `json:"operation"`
+	OperationTime int          `json:"operation_time"`
+	Dependencies  []string     `json:"-"`
+	Status        string       `json:"status"`
+	Result        *float64     `json:"result"`
+	Error         *ErrorDetail `json:"error,omitempty"`
+	Attempts      int          `json:"attempts"`
+	LeaseID       string       `json:"lease_id,omitempty"`
+	LeaseDeadline time.Time    `json:"-"`
+	// CriticalPath is the remaining time, in milliseconds, from the start of
+	// the task to the end of its expression. The scheduler runs tasks with
+	// longer paths first.
+	CriticalPath int `json:"critical_path"`
+	// AgentID is the agent that holds or last held the task; empty for
+	// anonymous agents.
+	AgentID string `json:"agent_id,omitempty"`
+	// ReadyAt is when the task was last queued for an agent, or evaluated
+	// by the orchestrator once its dependencies were resolved, DispatchedAt
+	// when it was last leased to an agent and ResultAt when its result or
+	// failure arrived. Tasks evaluated by the orchestrator have no
+	// DispatchedAt.
+	ReadyAt      *time.Time `json:"ready_at,omitempty"`
+	DispatchedAt *time.Time `json:"dispatched_at,omitempty"`
+	ResultAt     *time.Time `json:"result_at,omitempty"`
+	// TraceParent is the W3C trace context of the current lease, passed to
+	// the agent so that its work joins the trace of the expression.
+	TraceParent string `json:"-"`
 }
 
 type Token struct {
-	Type    TokenType
-	Value   string
-	IsUnary bool
+	Type     TokenType
+	Value    string
+	IsUnary  bool
+	ArgCount int
+	// Pos is the byte offset of numbers, identifiers and function names in
+	// the source expression, used in error messages.
+	Pos int
 }
 
 type Expression struct {
-	ID     string   `json:"id"`
-	Status string   `json:"status"`
-	Result *float64 `json:"result"`
-	Tasks  []*Task  `json:"-"`
-	mu     sync.Mutex
+	ID string `json:"id"`
+	// Seq is the number in the ID; it breaks ties between expressions
+	// created at the same time.
+	Seq       int          `json:"-"`
+	FormulaID string       `json:"formula_id,omitempty"`
+	Status    string       `json:"status"`
+	Result    *float64     `json:"result"`
+	Error     *ErrorDetail `json:"error,omitempty"`
+	Tasks     []*Task      `json:"-"`
+	// TasksFolded counts operations evaluated by the orchestrator itself,
+	// TasksDispatched the tasks handed to agents.
+	TasksFolded     int `json:"tasks_folded"`
+	TasksDispatched int `json:"tasks_dispatched"`
+	TasksDone       int `json:"tasks_done"`
+	// Priority and Deadline steer the scheduler across expressions; a nil
+	// Deadline means none.
+	Priority  int        `json:"priority"`
+	Deadline  *time.Time `json:"deadline,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	// FirstDispatchedAt is when the first task went to an agent and
+	// CompletedAt when the expression reached a final status.
+	FirstDispatchedAt *time.Time `json:"first_dispatched_at,omitempty"`
+	CompletedAt       *time.Time `json:"completed_at,omitempty"`
+	// QueueTime sums, over the tasks agents completed, the time from ready
+	// to dispatch; ComputeTime the time from dispatch to result.
+	QueueTime   time.Duration `json:"queue_time"`
+	ComputeTime time.Duration `json:"compute_time"`
+	// CallbackURL receives the final state of the expression; empty means
+	// no webhook.
+	CallbackURL string `json:"callback_url,omitempty"`
+	// TraceParent is the W3C trace context of the request that submitted
+	// the expression; its task spans are children of it.
+	TraceParent string `json:"trace_parent,omitempty"`
+	mu          sync.Mutex
+}
+
+// ErrorDetail describes why a task or an expression ended in the error state.
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 type TokenType int
 
+// Formula is an expression compiled once and evaluated many times with
+// different variable bindings.
+type Formula struct {
+	ID         string   `json:"id"`
+	Expression string   `json:"expression"`
+	Variables  []string `json:"variables"`
+	RPN        []Token  `json:"-"`
+}
+
 type ExpressionResponse struct {
-	ID     string   `json:"id"`
-	Status string   `json:"status"`
-	Result *float64 `json:"result,omitempty"`
+	ID        string       `json:"id"`
+	FormulaID string       `json:"formula_id,omitempty"`
+	Status    string       `json:"status"`
+	Result    *float64     `json:"result,omitempty"`
+	Error     *ErrorDetail `json:"error,omitempty"`
+
+	TasksFolded     int        `json:"tasks_folded"`
+	TasksDispatched int        `json:"tasks_dispatched"`
+	Priority        int        `json:"priority"`
+	Deadline        *time.Time `json:"deadline,omitempty"`
+	CallbackURL     string     `json:"callback_url,omitempty"`
+
+	CreatedAt         time.Time  `json:"created_at"`
+	FirstDispatchedAt *time.Time `json:"first_dispatched_at,omitempty"`
+	CompletedAt       *time.Time `json:"completed_at,omitempty"`
+	QueueTimeMs       int64      `json:"queue_time_ms"`
+	ComputeTimeMs     int64      `json:"compute_time_ms"`
+}
+
+// Delivery is a webhook waiting in the outbox to be sent to the callback URL
+// of a finished expression.
+type Delivery struct {
+	ID           string          `json:"id"`
+	ExpressionID string          `json:"expression_id"`
+	URL          string          `json:"url"`
+	Payload      json.RawMessage `json:"payload"`
+	Attempts     int             `json:"attempts"`
+	NextAttempt  time.Time       `json:"next_attempt"`
+}
+
+// Agent is a registered agent process.
+type Agent struct {
+	ID             string    `json:"id"`
+	Hostname       string    `json:"hostname"`
+	ComputingPower int       `json:"computing_power"`
+	Version        string    `json:"version"`
+	RegisteredAt   time.Time `json:"registered_at"`
+	LastSeen       time.Time `json:"last_seen"`
+}
+
+type AgentResponse struct {
+	ID             string    `json:"id"`
+	Hostname       string    `json:"hostname"`
+	ComputingPower int       `json:"computing_power"`
+	Version        string    `json:"version"`
+	RegisteredAt   time.Time `json:"registered_at"`
+	LastSeen       time.Time `json:"last_seen"`
+	Tasks          []string  `json:"tasks"`
+}
+
+// ExpressionEvent is a status transition or a task completion of an
+// expression, streamed to API clients.
+type ExpressionEvent struct {
+	Type         string       `json:"type"`
+	ExpressionID string       `json:"expression_id"`
+	Status       string       `json:"status"`
+	TasksDone    int          `json:"tasks_done"`
+	TasksTotal   int          `json:"tasks_total"`
+	Result       *float64     `json:"result,omitempty"`
+	Error        *ErrorDetail `json:"error,omitempty"`
+}
+
+// ExpressionGraph is the task DAG of an expression. Tasks are listed
+// dependencies first, so Root, the task producing the result, comes last.
+type ExpressionGraph struct {
+	Expression ExpressionResponse `json:"expression"`
+	Root       string             `json:"root,omitempty"`
+	Tasks      []TaskNode         `json:"tasks"`
+}
+
+// TaskNode is a task in an ExpressionGraph. Args are literals or the IDs of
+// the tasks in Dependencies.
+type TaskNode struct {
+	ID            string       `json:"id"`
+	Operation     string       `json:"operation"`
+	Args          []string     `json:"args"`
+	Dependencies  []string     `json:"dependencies"`
+	Status        string       `json:"status"`
+	AgentID       string       `json:"agent_id,omitempty"`
+	Attempts      int          `json:"attempts"`
+	OperationTime int          `json:"operation_time"`
+	CriticalPath  int          `json:"critical_path"`
+	ReadyAt       *time.Time   `json:"ready_at,omitempty"`
+	DispatchedAt  *time.Time   `json:"dispatched_at,omitempty"`
+	ResultAt      *time.Time   `json:"result_at,omitempty"`
+	Result        *float64     `json:"result"`
+	Error         *ErrorDetail `json:"error,omitempty"`
 }
 
 type TaskResponse struct {
-	ID            string  `json:"id"`
-	Arg1          float64 `json:"arg1"`
-	Arg2          float64 `json:"arg2"`
-	Operation     string  `json:"operation"`
-	OperationTime int     `json:"operation_time"`
+	ID            string    `json:"id"`
+	LeaseID       string    `json:"lease_id"`
+	Args          []float64 `json:"args"`
+	Operation     string    `json:"operation"`
+	OperationTime int       `json:"operation_time"`
+	TraceParent   string    `json:"trace_parent,omitempty"`
 }
@@ -6,7 +6,7 @@ import (
 )
 
 func IsOperator(s string) bool {
-	return strings.ContainsAny(s, "+-*/")
+	return strings.ContainsAny(s, "+-*/^%")
 }
 
 func IsNumber(s string) bool {
@@ -0,0 +1,113 @@
+// Package tracing sets up OpenTelemetry tracing for the orchestrator and the
+// agents, and carries trace context between them.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Exporters accepted by Setup.
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+// Config selects where spans go.
+type Config struct {
+	// ServiceName identifies the process in traces.
+	ServiceName string
+	// Exporter is ExporterNone, ExporterOTLP or ExporterStdout. The OTLP
+	// exporter sends spans over HTTP and is configured with the standard
+	// OTEL_EXPORTER_OTLP_* variables.
+	Exporter string
+	// File is where ExporterStdout writes spans, one JSON object each;
+	// empty means standard output.
+	File string
+}
+
+var propagator = propagation.TraceContext{}
+
+// exportInterval is how long finished spans may wait before being exported.
+// It is kept short so that spans show up right away when checking a trace
+// locally.
+const exportInterval = time.Second
+
+// Setup installs the global tracer provider. The returned function flushes
+// pending spans and must be called before the process exits. With
+// ExporterNone tracing stays disabled and spans cost next to nothing.
+func Setup(cfg Config) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+	switch cfg.Exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		otlp, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("create OTLP exporter: %w", err)
+		}
+		exporter = otlp
+	case ExporterStdout:
+		var w io.Writer = os.Stdout
+		if cfg.File != "" {
+			f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, fmt.Errorf("open trace file: %w", err)
+			}
+			w, closer = f, f
+		}
+		stdout, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return nil, fmt.Errorf("create stdout exporter: %w", err)
+		}
+		exporter = stdout
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, expected %q, %q or %q",
+			cfg.Exporter, ExporterNone, ExporterOTLP, ExporterStdout)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter, sdktrace.WithBatchTimeout(exportInterval)),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+// Inject returns the W3C traceparent of the span in ctx, or an empty string
+// when there is none.
+func Inject(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// Extract returns ctx with the remote span described by traceparent as its
+// parent. An empty or malformed traceparent leaves ctx unchanged.
+func Extract(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+}